@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"net"
+)
+
+// JSONMap is a shortcut for a JSON dictionary.
+type JSONMap map[string]interface{}
+
+// Backend defines which functions must every type of loadbalancer backend implement.
+// A backend keeps named sets of addresses, one for each LB Pool using it.
+type Backend interface {
+	// GetSet returns addresses currently present in named set of LB Pool.
+	GetSet(lbPool *lbpool.LBPool, name string) ([]net.IP, error)
+	// SyncSet changes named set so that it contains exactly wantSet. curSet is
+	// what GetSet has just returned, so backends need not read the set again.
+	// LB Pool owning the set is given for backends requiring more than addresses.
+	SyncSet(lbPool *lbpool.LBPool, name string, curSet []net.IP, wantSet []net.IP) error
+}
+
+// Transactional is implemented by backends which can apply changes of many
+// sets at once. Changes done between Begin and Commit are applied atomically.
+// If Commit fails, nothing is applied unless it returns CommitError.
+type Transactional interface {
+	Begin() error
+	Commit() error
+	Rollback()
+}
+
+// CommitError is returned by Commit which has applied changes of only some
+// of LB Pools. Sets of the Failed ones were not changed.
+type CommitError struct {
+	Failed []*lbpool.LBPool
+	Err    error
+}
+
+func (e CommitError) Error() string {
+	return e.Err.Error()
+}
+
+// Ticker is implemented by backends which must perform periodic work
+// independent of changes of sets.
+type Ticker interface {
+	Tick()
+}
+
+// Closer is implemented by backends holding resources, like listening sockets,
+// which must be released before backends are created again on configuration reload.
+type Closer interface {
+	Close()
+}
+
+// Preparer is implemented by backends which generate their own configuration
+// from all LB Pools using them. Prepare is called before any set is synced.
+type Preparer interface {
+	Prepare(lbPools []*lbpool.LBPool) error
+}
+
+// NewBackend is an object factory returning a proper Backend object depending
+// on configuration it reads from JSON. In dry run backends must not serve
+// anything to their clients.
+func NewBackend(name string, json JSONMap, dryRun bool) Backend {
+	btype, _ := json["type"].(string)
+
+	var b Backend
+
+	switch btype {
+	case "pf":
+		b = newPF(name, json)
+	case "memory":
+		b = newMemory(name, json)
+	case "nftables":
+		b = newNftables(name, json)
+	case "ipvs":
+		b = newIPVS(name, json)
+	case "ecmp":
+		b = newECMP(name, json)
+	case "haproxy":
+		b = newHAProxy(name, json)
+	case "envoy":
+		b = newEnvoy(name, json, dryRun)
+	case "file":
+		b = newFile(name, json)
+	default:
+		logger.Error.Printf("backend: %s unknown type %s", name, btype)
+		return nil
+	}
+
+	return b
+}
+
+// NewBackends creates all backends from JSON configuration. If none are configured,
+// a single pf backend named "pf" is created, as this is the default backend of LB Pools.
+func NewBackends(json JSONMap, dryRun bool) map[string]Backend {
+	if len(json) == 0 {
+		json = JSONMap{
+			lbpool.DefaultBackend: map[string]interface{}{"type": "pf"},
+		}
+	}
+
+	backends := map[string]Backend{}
+	for name, config := range json {
+		configMap, _ := config.(map[string]interface{})
+		if b := NewBackend(name, configMap, dryRun); b != nil {
+			backends[name] = b
+		}
+	}
+	return backends
+}
+
+// Diff compares current and wanted set of addresses and returns addresses
+// which must be added and deleted.
+func Diff(curSet []net.IP, wantSet []net.IP) ([]net.IP, []net.IP) {
+	var addSet, delSet []net.IP
+
+	cur := make(map[string]bool, len(curSet))
+	for _, ipAddress := range curSet {
+		cur[ipAddress.String()] = true
+	}
+	want := make(map[string]bool, len(wantSet))
+	for _, ipAddress := range wantSet {
+		want[ipAddress.String()] = true
+	}
+
+	// Add wanted nodes.
+	for _, ipAddress := range wantSet {
+		if cur[ipAddress.String()] == false {
+			addSet = append(addSet, ipAddress)
+		}
+	}
+
+	// Remove unwanted nodes.
+	for _, ipAddress := range curSet {
+		if want[ipAddress.String()] == false {
+			delSet = append(delSet, ipAddress)
+		}
+	}
+
+	return addSet, delSet
+}
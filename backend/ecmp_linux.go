@@ -0,0 +1,189 @@
+//go:build linux
+// +build linux
+
+package backend
+
+import (
+	"fmt"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"github.com/vishvananda/netlink"
+	"net"
+	"syscall"
+)
+
+// ecmpDefaultProtocol is route protocol number identifying routes of ECMP backend.
+const ecmpDefaultProtocol = 201
+
+// ECMP stores all properties of ECMP backend. Each LB Pool is a multipath host
+// route to its IP address with one nexthop per wanted LB Node. Routes are marked
+// with own protocol number, routes with other protocols are never touched.
+type ECMP struct {
+	name      string
+	logPrefix string
+	protocol  netlink.RouteProtocol
+	table     int
+	metric    int
+	seen      map[string]bool
+}
+
+// newECMP creates new ECMP backend.
+func newECMP(name string, json JSONMap) Backend {
+	b := new(ECMP)
+	b.name = name
+	b.logPrefix = "backend: " + name + " "
+	b.protocol = ecmpDefaultProtocol
+	b.table = syscall.RT_TABLE_MAIN
+	b.seen = map[string]bool{}
+
+	if protocol, ok := json["protocol"].(float64); ok && protocol > 0 && protocol < 256 {
+		b.protocol = netlink.RouteProtocol(protocol)
+	}
+	if table, ok := json["table"].(float64); ok && table > 0 {
+		b.table = int(table)
+	}
+	if metric, ok := json["metric"].(float64); ok && metric >= 0 {
+		b.metric = int(metric)
+	}
+
+	logger.Info.Printf(b.logPrefix+"type: ecmp protocol: %d table: %d created", b.protocol, b.table)
+	return b
+}
+
+// ecmpDst returns host prefix of IP address of LB Pool.
+func ecmpDst(lbPool *lbpool.LBPool) (*net.IPNet, int, error) {
+	ip := lbPool.GetIPAddress()
+	if ip == nil {
+		return nil, 0, fmt.Errorf("ecmp: invalid ip address of lb_pool")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, netlink.FAMILY_V4, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, netlink.FAMILY_V6, nil
+}
+
+// getRoute returns route to IP address of LB Pool in configured table.
+// Route of other protocol is reported as an error, it is not ours to change.
+func (b *ECMP) getRoute(lbPool *lbpool.LBPool) (*netlink.Route, error) {
+	dst, family, err := ecmpDst(lbPool)
+	if err != nil {
+		return nil, err
+	}
+	filter := &netlink.Route{Dst: dst, Table: b.table, Priority: b.metric}
+	routes, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PRIORITY)
+	if err != nil {
+		return nil, fmt.Errorf("ecmp: %v", err)
+	}
+	for _, route := range routes {
+		if route.Protocol != b.protocol {
+			return nil, fmt.Errorf("ecmp: route to %s has foreign protocol %d", dst, route.Protocol)
+		}
+		return &route, nil
+	}
+	return nil, nil
+}
+
+// ecmpNexthops returns gateways of route with their weights.
+func ecmpNexthops(route *netlink.Route) map[string]int {
+	ret := map[string]int{}
+	if route == nil {
+		return ret
+	}
+	if route.Gw != nil {
+		ret[route.Gw.String()] = 1
+	}
+	for _, nh := range route.MultiPath {
+		ret[nh.Gw.String()] = nh.Hops + 1
+	}
+	return ret
+}
+
+// GetSet returns gateways of route to IP address of LB Pool.
+func (b *ECMP) GetSet(lbPool *lbpool.LBPool, name string) ([]net.IP, error) {
+	route, err := b.getRoute(lbPool)
+	if err != nil {
+		return nil, err
+	}
+	var ret []net.IP
+	for gw := range ecmpNexthops(route) {
+		ret = append(ret, net.ParseIP(gw))
+	}
+	return ret, nil
+}
+
+// SyncSet replaces route to IP address of LB Pool with a single netlink
+// operation. Each wanted LB Node is a nexthop with its configured weight.
+// Route is deleted if there are no wanted LB Nodes.
+func (b *ECMP) SyncSet(lbPool *lbpool.LBPool, name string, curSet []net.IP, wantSet []net.IP) error {
+	dst, family, err := ecmpDst(lbPool)
+	if err != nil {
+		return err
+	}
+	cur, err := b.getRoute(lbPool)
+	if err != nil {
+		return err
+	}
+
+	// Existing kernel route is reconciled once after start or reload.
+	if b.seen[dst.String()] == false {
+		b.seen[dst.String()] = true
+		if cur != nil {
+			logger.Info.Printf(b.logPrefix+"route: %s found with %d nexthops", dst, len(ecmpNexthops(cur)))
+		}
+	}
+
+	if len(wantSet) == 0 {
+		if cur == nil {
+			return nil
+		}
+		logger.Debug.Printf(b.logPrefix+"route: %s deleting", dst)
+		if err := netlink.RouteDel(cur); err != nil {
+			return fmt.Errorf("ecmp: %v", err)
+		}
+		return nil
+	}
+
+	weights := map[string]int{}
+	for _, node := range lbPool.GetNodes() {
+		weights[node.IPAddress.String()] = node.Weight
+	}
+
+	want := map[string]int{}
+	route := &netlink.Route{
+		Dst:      dst,
+		Family:   family,
+		Table:    b.table,
+		Priority: b.metric,
+		Protocol: b.protocol,
+	}
+	for _, ip := range wantSet {
+		weight := weights[ip.String()]
+		if weight < 1 {
+			weight = 1
+		}
+		if weight > 256 {
+			weight = 256
+		}
+		want[ip.String()] = weight
+		route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{Gw: ip, Hops: weight - 1})
+	}
+
+	// Nothing to do if kernel already has the same nexthops.
+	if curHops := ecmpNexthops(cur); len(curHops) == len(want) {
+		same := true
+		for gw, weight := range want {
+			if curHops[gw] != weight {
+				same = false
+			}
+		}
+		if same {
+			return nil
+		}
+	}
+
+	logger.Debug.Printf(b.logPrefix+"route: %s nexthops: %v", dst, want)
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("ecmp: %v", err)
+	}
+	return nil
+}
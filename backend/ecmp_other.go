@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package backend
+
+import (
+	"github.com/innogames/yacht/logger"
+)
+
+// newECMP reports that ECMP backend is available only on Linux.
+func newECMP(name string, json JSONMap) Backend {
+	logger.Error.Printf("backend: %s type: ecmp is supported only on Linux", name)
+	return nil
+}
@@ -0,0 +1,195 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	server "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"net"
+	"time"
+)
+
+// Envoy stores all properties of Envoy backend. It serves Endpoint Discovery
+// Service over gRPC. Each LB Pool is a cluster, named in backend_options of
+// LB Pool or same as the set. IPv4 and IPv6 LB Pools naming the same cluster
+// share it, each providing endpoints of its own protocol. Every LB Node is
+// an endpoint: wanted ones are healthy, other up ones are draining and down
+// ones are unhealthy. Backup LB Nodes have lower priority than primary ones.
+type Envoy struct {
+	name      string
+	logPrefix string
+	listen    string
+
+	// Operation
+	cache      *cache.LinearCache
+	grpcServer *grpc.Server
+	cancel     context.CancelFunc
+	sets       map[string][]net.IP
+	endpoints  map[string]map[string]envoyEndpoints
+}
+
+// envoyEndpoints are endpoints of cluster coming from one LB Pool.
+type envoyEndpoints struct {
+	primary []*endpoint.LbEndpoint
+	backup  []*endpoint.LbEndpoint
+}
+
+// newEnvoy creates new Envoy backend and starts its gRPC server.
+func newEnvoy(name string, json JSONMap, dryRun bool) Backend {
+	b := new(Envoy)
+	b.name = name
+	b.logPrefix = "backend: " + name + " "
+	b.listen = "127.0.0.1:18000"
+	b.sets = map[string][]net.IP{}
+	b.endpoints = map[string]map[string]envoyEndpoints{}
+
+	if listen, ok := json["listen"].(string); ok {
+		b.listen = listen
+	}
+
+	// Dry run only reads sets, real Envoys must not get its endpoints.
+	if dryRun {
+		logger.Info.Printf(b.logPrefix+"type: envoy listen: %s created, not serving in dry run", b.listen)
+		return b
+	}
+
+	listener, err := net.Listen("tcp", b.listen)
+	if err != nil {
+		logger.Error.Printf(b.logPrefix+"unable to listen: %v", err)
+		return nil
+	}
+
+	// Versions must differ from those of previous instance, so that Envoys
+	// reconnecting after restart or reload get full update.
+	b.cache = cache.NewLinearCache(
+		resource.EndpointType,
+		cache.WithVersionPrefix(fmt.Sprintf("%d-", time.Now().UnixNano())),
+	)
+
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(context.Background())
+	xdsServer := server.NewServer(ctx, b.cache, nil)
+	b.grpcServer = grpc.NewServer()
+	endpointservice.RegisterEndpointDiscoveryServiceServer(b.grpcServer, xdsServer)
+
+	go func() {
+		if err := b.grpcServer.Serve(listener); err != nil {
+			logger.Error.Printf(b.logPrefix+"grpc: %v", err)
+		}
+	}()
+
+	logger.Info.Printf(b.logPrefix+"type: envoy listen: %s created", b.listen)
+	return b
+}
+
+// envoyCluster returns name of Envoy cluster of LB Pool.
+func envoyCluster(lbPool *lbpool.LBPool, name string) string {
+	if cluster, ok := lbPool.GetBackendOptions()["cluster"].(string); ok {
+		return cluster
+	}
+	return name
+}
+
+// GetSet returns addresses of healthy endpoints of LB Pool last sent to Envoy.
+func (b *Envoy) GetSet(lbPool *lbpool.LBPool, name string) ([]net.IP, error) {
+	return b.sets[name], nil
+}
+
+// SyncSet builds new load assignment of cluster from endpoints of LB Pool and
+// of LB Pool of the other protocol sharing the cluster, and pushes it to all
+// Envoys watching this cluster.
+func (b *Envoy) SyncSet(lbPool *lbpool.LBPool, name string, curSet []net.IP, wantSet []net.IP) error {
+	cluster := envoyCluster(lbPool, name)
+
+	port, ok := lbPool.GetBackendOptions()["port"].(float64)
+	if !ok || port <= 0 || port > 65535 {
+		return fmt.Errorf("envoy: missing or invalid port in backend_options")
+	}
+
+	var poolEndpoints envoyEndpoints
+	for _, node := range lbPool.GetNodes() {
+		status := core.HealthStatus_UNHEALTHY
+		if node.State == lbpool.NodeUp {
+			status = core.HealthStatus_DRAINING
+		}
+		for _, want := range wantSet {
+			if want.Equal(node.IPAddress) {
+				status = core.HealthStatus_HEALTHY
+			}
+		}
+
+		lbEndpoint := &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Address: node.IPAddress.String(),
+								PortSpecifier: &core.SocketAddress_PortValue{
+									PortValue: uint32(port),
+								},
+							},
+						},
+					},
+					Hostname: node.Name,
+				},
+			},
+			HealthStatus: status,
+		}
+		// Envoy does not accept weight 0, such LB Nodes get default weight.
+		if node.Weight > 0 {
+			lbEndpoint.LoadBalancingWeight = wrapperspb.UInt32(uint32(node.Weight))
+		}
+
+		if node.Primary {
+			poolEndpoints.primary = append(poolEndpoints.primary, lbEndpoint)
+		} else {
+			poolEndpoints.backup = append(poolEndpoints.backup, lbEndpoint)
+		}
+	}
+
+	if b.endpoints[cluster] == nil {
+		b.endpoints[cluster] = map[string]envoyEndpoints{}
+	}
+	b.endpoints[cluster][lbPool.GetProto()] = poolEndpoints
+	var primary, backup []*endpoint.LbEndpoint
+	for _, proto := range []string{"4", "6"} {
+		primary = append(primary, b.endpoints[cluster][proto].primary...)
+		backup = append(backup, b.endpoints[cluster][proto].backup...)
+	}
+
+	// Priorities must start from 0 without gaps.
+	cla := &endpoint.ClusterLoadAssignment{ClusterName: cluster}
+	for _, lbEndpoints := range [][]*endpoint.LbEndpoint{primary, backup} {
+		if len(lbEndpoints) > 0 {
+			cla.Endpoints = append(cla.Endpoints, &endpoint.LocalityLbEndpoints{
+				LbEndpoints: lbEndpoints,
+				Priority:    uint32(len(cla.Endpoints)),
+			})
+		}
+	}
+
+	if err := b.cache.UpdateResource(cluster, cla); err != nil {
+		return fmt.Errorf("envoy: %v", err)
+	}
+	logger.Debug.Printf(b.logPrefix+"cluster: %s healthy: %s", cluster, wantSet)
+	b.sets[name] = wantSet
+	return nil
+}
+
+// Close stops gRPC server, Envoys will reconnect to the new one.
+func (b *Envoy) Close() {
+	if b.grpcServer == nil {
+		return
+	}
+	b.grpcServer.Stop()
+	b.cancel()
+}
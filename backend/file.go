@@ -0,0 +1,227 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// File stores all properties of file backend. Wanted nodes of each LB Pool are
+// rendered through a template into a file, both configured in backend_options
+// of LB Pool. IPv4 and IPv6 LB Pools share backend_options, so each of them
+// reads its file from path4 or path6, falling back to path. Two sets must not
+// be written into the same file. A reload command is run when any of files
+// has changed. Bursts of changes are merged together so the command is not
+// run too often. Failed reload fails sync of LB Pools whose files changed.
+type File struct {
+	name          string
+	logPrefix     string
+	reloadCommand string
+	debounce      time.Duration
+
+	// Operation
+	templates     map[string]*template.Template
+	sets          map[string][]net.IP
+	paths         map[string]string
+	reloadPending bool
+	reloadAfter   time.Time
+	reloadPools   map[*lbpool.LBPool]bool
+	reloadErr     error
+}
+
+// FileTemplateData is passed to templates of file backend.
+type FileTemplateData struct {
+	// Name of the set, pf_name with protocol suffix
+	Name string
+	// Name of LB Pool, also with protocol suffix
+	Pool string
+	// IP protocol version, "4" or "6"
+	Proto string
+	// IP address of LB Pool
+	IPAddress net.IP
+	// Wanted LB Nodes
+	Nodes []lbpool.NodeInfo
+	// All LB Nodes
+	AllNodes []lbpool.NodeInfo
+}
+
+// newFile creates new file backend and populates it with data from JSON config.
+func newFile(name string, json JSONMap) Backend {
+	b := new(File)
+	b.name = name
+	b.logPrefix = "backend: " + name + " "
+	b.templates = map[string]*template.Template{}
+	b.sets = map[string][]net.IP{}
+	b.paths = map[string]string{}
+	b.reloadPools = map[*lbpool.LBPool]bool{}
+	b.debounce = time.Second
+
+	if reloadCommand, ok := json["reload_command"].(string); ok {
+		b.reloadCommand = reloadCommand
+	}
+	if debounce, ok := json["debounce"].(float64); ok && debounce >= 0 {
+		b.debounce = time.Millisecond * time.Duration(debounce)
+	}
+
+	logger.Info.Printf("%stype: file created", b.logPrefix)
+	return b
+}
+
+type fileError struct {
+	s string
+}
+
+func (e fileError) Error() string {
+	return "file: " + e.s
+}
+
+// getTemplate loads and parses template, parsed templates are cached.
+func (b *File) getTemplate(path string) (*template.Template, error) {
+	if tmpl, ok := b.templates[path]; ok {
+		return tmpl, nil
+	}
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, fileError{err.Error()}
+	}
+	b.templates[path] = tmpl
+	return tmpl, nil
+}
+
+// GetSet returns addresses last rendered into file of LB Pool.
+func (b *File) GetSet(lbPool *lbpool.LBPool, name string) ([]net.IP, error) {
+	return b.sets[name], nil
+}
+
+// SyncSet renders wanted nodes of LB Pool and writes them into its file.
+// If content of file has changed, reload command is scheduled.
+func (b *File) SyncSet(lbPool *lbpool.LBPool, name string, curSet []net.IP, wantSet []net.IP) error {
+	options := lbPool.GetBackendOptions()
+	path, ok := options["path"+lbPool.GetProto()].(string)
+	if !ok {
+		path, _ = options["path"].(string)
+	}
+	templatePath, _ := options["template"].(string)
+	if path == "" || templatePath == "" {
+		return fileError{"path and template must be set in backend_options"}
+	}
+	if owner, ok := b.paths[path]; ok && owner != name {
+		return fileError{fmt.Sprintf("path %s is already used by set %s, set path4 and path6", path, owner)}
+	}
+	b.paths[path] = name
+
+	tmpl, err := b.getTemplate(templatePath)
+	if err != nil {
+		return err
+	}
+
+	data := FileTemplateData{
+		Name:      name,
+		Pool:      lbPool.GetName(),
+		Proto:     lbPool.GetProto(),
+		IPAddress: lbPool.GetIPAddress(),
+		AllNodes:  lbPool.GetNodes(),
+	}
+	for _, node := range data.AllNodes {
+		for _, want := range wantSet {
+			if want.Equal(node.IPAddress) {
+				data.Nodes = append(data.Nodes, node)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return fileError{err.Error()}
+	}
+
+	// Do not touch the file if nothing has changed. It is not applied
+	// until reload command succeeds.
+	if cur, err := ioutil.ReadFile(path); err == nil && bytes.Equal(cur, out.Bytes()) {
+		b.sets[name] = wantSet
+		if b.reloadPools[lbPool] && b.reloadErr != nil {
+			return b.reloadErr
+		}
+		return nil
+	}
+
+	if err := writeFileAtomic(path, out.Bytes()); err != nil {
+		return err
+	}
+	logger.Info.Printf(b.logPrefix+"file: %s written", path)
+	b.sets[name] = wantSet
+
+	if b.reloadCommand != "" {
+		b.reloadPending = true
+		b.reloadAfter = time.Now().Add(b.debounce)
+		b.reloadPools[lbPool] = true
+	}
+	return nil
+}
+
+// writeFileAtomic writes file so that readers see either old or new content,
+// never a partially written one.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return fileError{err.Error()}
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fileError{err.Error()}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fileError{err.Error()}
+	}
+	if err := tmp.Close(); err != nil {
+		return fileError{err.Error()}
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fileError{err.Error()}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fileError{err.Error()}
+	}
+	return nil
+}
+
+// Tick runs reload command once changes of files have settled down.
+// Failed reload is retried after another debounce period. Its failure is
+// reported as failed sync of affected LB Pools, until it succeeds.
+func (b *File) Tick() {
+	if b.reloadPending == false || time.Now().Before(b.reloadAfter) {
+		return
+	}
+
+	logger.Info.Printf(b.logPrefix+"reload: %s", b.reloadCommand)
+	out, err := exec.Command("/bin/sh", "-c", b.reloadCommand).CombinedOutput()
+	if err != nil {
+		b.reloadErr = fileError{fmt.Sprintf("reload command failed: %s\n%s", err, out)}
+		for lbPool := range b.reloadPools {
+			logger.Error.Printf("%s%v", lbPool.GetLogPrefix(), b.reloadErr)
+			lbPool.SyncFailed()
+		}
+		b.reloadAfter = time.Now().Add(b.debounce)
+		return
+	}
+
+	if b.reloadErr != nil {
+		for lbPool := range b.reloadPools {
+			lbPool.SyncSucceeded()
+		}
+	}
+	b.reloadErr = nil
+	b.reloadPending = false
+	b.reloadPools = map[*lbpool.LBPool]bool{}
+}
@@ -0,0 +1,55 @@
+package backend
+
+import (
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileReloadFailure(t *testing.T) {
+	logger.InitLoggers(false)
+
+	dir := t.TempDir()
+	templatePath := filepath.Join(dir, "nodes.tmpl")
+	if err := ioutil.WriteFile(templatePath, []byte("{{range .Nodes}}{{.IPAddress}}\n{{end}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := newFile("file", JSONMap{"reload_command": "exit 3", "debounce": 0.0}).(*File)
+	lbPool := lbpool.NewLBPool("4", "web", map[string]interface{}{
+		"ip4":     "192.0.2.1",
+		"pf_name": "web",
+		"backend_options": map[string]interface{}{
+			"path":     filepath.Join(dir, "nodes"),
+			"template": templatePath,
+		},
+		"healthchecks": []interface{}{},
+		"nodes": map[string]interface{}{
+			"node1": map[string]interface{}{"ip4": "192.0.2.10"},
+		},
+	})
+	wantSet := []net.IP{net.ParseIP("192.0.2.10")}
+
+	if err := b.SyncSet(lbPool, lbPool.GetPFName(), nil, wantSet); err != nil {
+		t.Fatal(err)
+	}
+	b.Tick()
+
+	// Retried sync reports reload failure although the file is written.
+	err := b.SyncSet(lbPool, lbPool.GetPFName(), wantSet, wantSet)
+	if err == nil || strings.Contains(err.Error(), "reload command failed") == false {
+		t.Errorf("failed reload not reported: %v", err)
+	}
+
+	b.reloadCommand = "true"
+	b.Tick()
+	if err := b.SyncSet(lbPool, lbPool.GetPFName(), wantSet, wantSet); err != nil {
+		t.Errorf("successful reload still reported: %v", err)
+	}
+	if b.reloadPending {
+		t.Error("reload still pending")
+	}
+}
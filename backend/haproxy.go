@@ -0,0 +1,210 @@
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Administrative state flags of HAProxy server which are controlled by us.
+const (
+	haproxyAdminMaint = 0x01
+	haproxyAdminDrain = 0x08
+)
+
+// HAProxy stores all properties of HAProxy backend. It pushes our health
+// decisions over HAProxy runtime API. Each LB Pool is a HAProxy backend,
+// named in backend_options of LB Pool with protocol suffix "_4" or "_6"
+// appended, or same as the set, and each LB Node is a server of the same
+// name. Wanted LB Nodes are set to ready, other up LB Nodes are drained and
+// down ones are put into maintenance.
+type HAProxy struct {
+	name      string
+	logPrefix string
+	network   string
+	address   string
+	timeout   time.Duration
+}
+
+// haproxyServer is state of HAProxy server as reported by "show servers state".
+type haproxyServer struct {
+	name       string
+	ipAddress  net.IP
+	adminState int
+}
+
+// newHAProxy creates new HAProxy backend and populates it with data from JSON config.
+func newHAProxy(name string, json JSONMap) Backend {
+	b := new(HAProxy)
+	b.name = name
+	b.logPrefix = "backend: " + name + " "
+	b.network = "unix"
+	b.address = "/var/run/haproxy.sock"
+	b.timeout = 5 * time.Second
+
+	// Socket is either a path to unix socket or host:port of TCP socket.
+	if socket, ok := json["socket"].(string); ok {
+		b.address = socket
+		if strings.HasPrefix(socket, "/") == false {
+			b.network = "tcp"
+		}
+	}
+	if timeout, ok := json["timeout"].(float64); ok && timeout > 0 {
+		b.timeout = time.Millisecond * time.Duration(timeout)
+	}
+
+	logger.Info.Printf(b.logPrefix+"type: haproxy socket: %s created", b.address)
+	return b
+}
+
+type haproxyError struct {
+	s string
+}
+
+func (e haproxyError) Error() string {
+	return "haproxy: " + e.s
+}
+
+// haproxyCmd sends a single command to HAProxy runtime API and returns its output.
+func (b *HAProxy) haproxyCmd(cmd string) (string, error) {
+	conn, err := net.DialTimeout(b.network, b.address, b.timeout)
+	if err != nil {
+		return "", haproxyError{err.Error()}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(b.timeout))
+
+	logger.Debug.Printf(b.logPrefix+"command: %s", cmd)
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", haproxyError{err.Error()}
+	}
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", haproxyError{err.Error()}
+	}
+	return string(out), nil
+}
+
+// haproxyBackend returns name of HAProxy backend of LB Pool. IPv4 and IPv6
+// LB Pools share backend_options, so each of them gets its own HAProxy backend
+// whose servers have addresses of a single protocol.
+func haproxyBackend(lbPool *lbpool.LBPool, name string) string {
+	if backend, ok := lbPool.GetBackendOptions()["haproxy_backend"].(string); ok {
+		return backend + "_" + lbPool.GetProto()
+	}
+	return name
+}
+
+// getServers reads state of all servers of HAProxy backend.
+func (b *HAProxy) getServers(backend string) (map[string]haproxyServer, error) {
+	out, err := b.haproxyCmd("show servers state " + backend)
+	if err != nil {
+		return nil, err
+	}
+
+	// First line is version of format, then a comment with field names
+	// and then one line for each server:
+	// be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state ...
+	servers := map[string]haproxyServer{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 1 {
+			// Version of format.
+			continue
+		}
+		if len(fields) < 7 {
+			// Anything else is an error message, e.g. unknown backend.
+			return nil, haproxyError{strings.TrimSpace(out)}
+		}
+		adminState, err := strconv.Atoi(fields[6])
+		if err != nil {
+			return nil, haproxyError{"unable to parse server state: " + scanner.Text()}
+		}
+		servers[fields[3]] = haproxyServer{
+			name:       fields[3],
+			ipAddress:  net.ParseIP(fields[4]),
+			adminState: adminState,
+		}
+	}
+	return servers, nil
+}
+
+// GetSet returns addresses of servers which are neither drained nor in maintenance.
+func (b *HAProxy) GetSet(lbPool *lbpool.LBPool, name string) ([]net.IP, error) {
+	servers, err := b.getServers(haproxyBackend(lbPool, name))
+	if err != nil {
+		return nil, err
+	}
+	var ret []net.IP
+	for _, server := range servers {
+		if server.adminState&(haproxyAdminMaint|haproxyAdminDrain) == 0 && server.ipAddress != nil {
+			ret = append(ret, server.ipAddress)
+		}
+	}
+	return ret, nil
+}
+
+// SyncSet reconciles state and address of all servers of HAProxy backend with
+// LB Nodes of LB Pool. Only commands changing something are sent.
+func (b *HAProxy) SyncSet(lbPool *lbpool.LBPool, name string, curSet []net.IP, wantSet []net.IP) error {
+	backend := haproxyBackend(lbPool, name)
+	servers, err := b.getServers(backend)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range lbPool.GetNodes() {
+		server, ok := servers[node.Name]
+		if !ok {
+			logger.Warning.Printf(b.logPrefix+"backend: %s has no server %s", backend, node.Name)
+			continue
+		}
+		srv := backend + "/" + node.Name
+
+		// Address of server should be the one of LB Node.
+		if server.ipAddress == nil || server.ipAddress.Equal(node.IPAddress) == false {
+			out, err := b.haproxyCmd("set server " + srv + " addr " + node.IPAddress.String())
+			if err != nil {
+				return err
+			}
+			if strings.Contains(out, "changed") == false && strings.Contains(out, "no need") == false {
+				return haproxyError{strings.TrimSpace(out)}
+			}
+		}
+
+		// Wanted LB Nodes are ready, others are drained or in maintenance.
+		state, adminState := "maint", haproxyAdminMaint
+		for _, want := range wantSet {
+			if want.Equal(node.IPAddress) {
+				state, adminState = "ready", 0
+			}
+		}
+		if adminState != 0 && node.State == lbpool.NodeUp {
+			state, adminState = "drain", haproxyAdminDrain
+		}
+		if server.adminState&(haproxyAdminMaint|haproxyAdminDrain) == adminState {
+			continue
+		}
+		logger.Debug.Printf(b.logPrefix+"server: %s state: %s", srv, state)
+		out, err := b.haproxyCmd("set server " + srv + " state " + state)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(out) != "" {
+			return haproxyError{fmt.Sprintf("%s: %s", srv, strings.TrimSpace(out))}
+		}
+	}
+
+	return nil
+}
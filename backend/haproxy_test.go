@@ -0,0 +1,177 @@
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeHAProxyServer is a server of fakeHAProxy.
+type fakeHAProxyServer struct {
+	addr       string
+	adminState int
+}
+
+// fakeHAProxy serves the part of HAProxy runtime API used by HAProxy backend
+// on a unix socket and records all commands changing something.
+type fakeHAProxy struct {
+	sync.Mutex
+	listener net.Listener
+	backends map[string]map[string]*fakeHAProxyServer
+	changes  []string
+}
+
+func newFakeHAProxy(t *testing.T, backends map[string]map[string]*fakeHAProxyServer) *fakeHAProxy {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "haproxy.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeHAProxy{listener: listener, backends: backends}
+	go f.serve()
+	t.Cleanup(func() { listener.Close() })
+	return f
+}
+
+func (f *fakeHAProxy) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		cmd, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte(f.handle(strings.TrimSpace(cmd))))
+		conn.Close()
+	}
+}
+
+func (f *fakeHAProxy) handle(cmd string) string {
+	defer f.Unlock()
+	f.Lock()
+
+	fields := strings.Fields(cmd)
+	if strings.HasPrefix(cmd, "show servers state ") {
+		servers, ok := f.backends[fields[3]]
+		if !ok {
+			return "Can't find backend.\n"
+		}
+		out := "1\n# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state\n"
+		for name, server := range servers {
+			out += fmt.Sprintf("1 %s 1 %s %s 2 %d\n", fields[3], name, server.addr, server.adminState)
+		}
+		return out
+	}
+
+	if len(fields) != 5 || fields[0] != "set" || fields[1] != "server" {
+		return "Unknown command.\n"
+	}
+	srv := strings.SplitN(fields[2], "/", 2)
+	server, ok := f.backends[srv[0]][srv[1]]
+	if !ok {
+		return "No such server.\n"
+	}
+	f.changes = append(f.changes, cmd)
+	switch fields[3] {
+	case "addr":
+		server.addr = fields[4]
+		return "IP changed\n"
+	case "state":
+		server.adminState = map[string]int{"ready": 0, "drain": haproxyAdminDrain, "maint": haproxyAdminMaint}[fields[4]]
+		return ""
+	}
+	return "Unknown command.\n"
+}
+
+func (f *fakeHAProxy) takeChanges() []string {
+	defer f.Unlock()
+	f.Lock()
+	changes := f.changes
+	f.changes = nil
+	return changes
+}
+
+func TestHAProxyBackendPerProtocol(t *testing.T) {
+	logger.InitLoggers(false)
+
+	fake := newFakeHAProxy(t, map[string]map[string]*fakeHAProxyServer{
+		"web_4": {"node1": {"0.0.0.0", haproxyAdminMaint}},
+		"web_6": {"node1": {"::", haproxyAdminMaint}},
+	})
+	b := newHAProxy("haproxy", JSONMap{"socket": fake.listener.Addr().String()})
+
+	poolConfig := map[string]interface{}{
+		"ip4":             "192.0.2.1",
+		"ip6":             "2001:db8::1",
+		"pf_name":         "web",
+		"backend_options": map[string]interface{}{"haproxy_backend": "web"},
+		"healthchecks":    []interface{}{},
+		"nodes": map[string]interface{}{
+			"node1": map[string]interface{}{"ip4": "192.0.2.10", "ip6": "2001:db8::10"},
+		},
+	}
+	lbPool4 := lbpool.NewLBPool("4", "web", poolConfig)
+	lbPool6 := lbpool.NewLBPool("6", "web", poolConfig)
+	want4 := []net.IP{net.ParseIP("192.0.2.10")}
+	want6 := []net.IP{net.ParseIP("2001:db8::10")}
+
+	apply := func(lbPool *lbpool.LBPool, wantSet []net.IP) {
+		curSet, err := b.GetSet(lbPool, lbPool.GetPFName())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SyncSet(lbPool, lbPool.GetPFName(), curSet, wantSet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	apply(lbPool4, want4)
+	apply(lbPool6, want6)
+	changes := strings.Join(fake.takeChanges(), "\n")
+	for _, want := range []string{
+		"set server web_4/node1 addr 192.0.2.10",
+		"set server web_4/node1 state ready",
+		"set server web_6/node1 addr 2001:db8::10",
+		"set server web_6/node1 state ready",
+	} {
+		if strings.Contains(changes, want) == false {
+			t.Errorf("missing command %q in:\n%s", want, changes)
+		}
+	}
+
+	// Both protocols synced again must not change addresses back and forth.
+	apply(lbPool4, want4)
+	apply(lbPool6, want6)
+	if changes := fake.takeChanges(); len(changes) > 0 {
+		t.Errorf("unexpected commands on second sync: %s", changes)
+	}
+
+	curSet, err := b.GetSet(lbPool4, lbPool4.GetPFName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addSet, delSet := Diff(curSet, want4); len(addSet) > 0 || len(delSet) > 0 {
+		t.Errorf("GetSet returned %s, want %s", curSet, want4)
+	}
+}
+
+func TestHAProxyUnknownBackend(t *testing.T) {
+	logger.InitLoggers(false)
+
+	fake := newFakeHAProxy(t, map[string]map[string]*fakeHAProxyServer{})
+	b := newHAProxy("haproxy", JSONMap{"socket": fake.listener.Addr().String()})
+	lbPool := lbpool.NewLBPool("4", "web", map[string]interface{}{
+		"ip4":          "192.0.2.1",
+		"pf_name":      "web",
+		"healthchecks": []interface{}{},
+		"nodes":        map[string]interface{}{},
+	})
+
+	if _, err := b.GetSet(lbPool, lbPool.GetPFName()); err == nil {
+		t.Fatal("unknown HAProxy backend not reported")
+	}
+}
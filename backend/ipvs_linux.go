@@ -0,0 +1,220 @@
+//go:build linux
+// +build linux
+
+package backend
+
+import (
+	"fmt"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"github.com/moby/ipvs"
+	"net"
+	"syscall"
+)
+
+// ipvsFlagPersistent marks IPVS virtual service as persistent.
+const ipvsFlagPersistent = 0x1
+
+// IPVS stores all properties of IPVS backend. Each LB Pool is a virtual service,
+// its IP address and port taken from backend options of LB Pool. LB Nodes are
+// real servers, the ones not wanted get weight 0 so their connections survive.
+type IPVS struct {
+	name      string
+	logPrefix string
+	handle    *ipvs.Handle
+}
+
+// newIPVS creates new IPVS backend.
+func newIPVS(name string, json JSONMap) Backend {
+	b := new(IPVS)
+	b.name = name
+	b.logPrefix = "backend: " + name + " "
+	logger.Info.Printf(b.logPrefix + "type: ipvs created")
+	return b
+}
+
+// getHandle returns netlink handle, it is opened on first use.
+func (b *IPVS) getHandle() (*ipvs.Handle, error) {
+	if b.handle == nil {
+		handle, err := ipvs.New("")
+		if err != nil {
+			return nil, fmt.Errorf("ipvs: %v", err)
+		}
+		b.handle = handle
+	}
+	return b.handle, nil
+}
+
+// ipvsService builds IPVS virtual service from configuration of LB Pool.
+// It also returns port and forwarding method of real servers.
+func ipvsService(lbPool *lbpool.LBPool) (*ipvs.Service, uint16, uint32, error) {
+	options := lbPool.GetBackendOptions()
+
+	port, ok := options["port"].(float64)
+	if !ok || port <= 0 || port > 65535 {
+		return nil, 0, 0, fmt.Errorf("ipvs: missing or invalid port in backend_options")
+	}
+
+	svc := &ipvs.Service{
+		Address:       lbPool.GetIPAddress(),
+		Protocol:      syscall.IPPROTO_TCP,
+		Port:          uint16(port),
+		SchedName:     ipvs.WeightedRoundRobin,
+		AddressFamily: syscall.AF_INET,
+		Netmask:       0xffffffff,
+	}
+	if svc.Address == nil {
+		return nil, 0, 0, fmt.Errorf("ipvs: invalid ip address of lb_pool")
+	}
+	if lbPool.GetProto() == "6" {
+		svc.AddressFamily = syscall.AF_INET6
+		svc.Netmask = 128
+	}
+
+	if protocol, ok := options["protocol"].(string); ok {
+		switch protocol {
+		case "tcp":
+			svc.Protocol = syscall.IPPROTO_TCP
+		case "udp":
+			svc.Protocol = syscall.IPPROTO_UDP
+		default:
+			return nil, 0, 0, fmt.Errorf("ipvs: unknown protocol %s", protocol)
+		}
+	}
+	if scheduler, ok := options["scheduler"].(string); ok {
+		svc.SchedName = scheduler
+	}
+	if persistence, ok := options["persistence"].(float64); ok && persistence > 0 {
+		svc.Flags |= ipvsFlagPersistent
+		svc.Timeout = uint32(persistence)
+	}
+
+	nodePort := svc.Port
+	if np, ok := options["node_port"].(float64); ok && np > 0 && np <= 65535 {
+		nodePort = uint16(np)
+	}
+
+	forward := uint32(ipvs.ConnectionFlagDirectRoute)
+	if fwd, ok := options["forward"].(string); ok {
+		switch fwd {
+		case "dr":
+			forward = ipvs.ConnectionFlagDirectRoute
+		case "nat":
+			forward = ipvs.ConnectionFlagMasq
+		case "tunnel":
+			forward = ipvs.ConnectionFlagTunnel
+		default:
+			return nil, 0, 0, fmt.Errorf("ipvs: unknown forward %s", fwd)
+		}
+	}
+
+	return svc, nodePort, forward, nil
+}
+
+// GetSet returns addresses of real servers with non-zero weight.
+func (b *IPVS) GetSet(lbPool *lbpool.LBPool, name string) ([]net.IP, error) {
+	handle, err := b.getHandle()
+	if err != nil {
+		return nil, err
+	}
+	svc, _, _, err := ipvsService(lbPool)
+	if err != nil {
+		return nil, err
+	}
+	if handle.IsServicePresent(svc) == false {
+		return nil, nil
+	}
+
+	dests, err := handle.GetDestinations(svc)
+	if err != nil {
+		return nil, fmt.Errorf("ipvs: %v", err)
+	}
+	var ret []net.IP
+	for _, dest := range dests {
+		if dest.Weight > 0 {
+			ret = append(ret, dest.Address)
+		}
+	}
+	return ret, nil
+}
+
+// SyncSet creates or updates virtual service of LB Pool and sets weight
+// of its real servers. Wanted LB Nodes get their configured weight, others
+// get weight 0. Real servers not belonging to any LB Node are deleted.
+func (b *IPVS) SyncSet(lbPool *lbpool.LBPool, name string, curSet []net.IP, wantSet []net.IP) error {
+	handle, err := b.getHandle()
+	if err != nil {
+		return err
+	}
+	svc, nodePort, forward, err := ipvsService(lbPool)
+	if err != nil {
+		return err
+	}
+
+	if handle.IsServicePresent(svc) {
+		if err := handle.UpdateService(svc); err != nil {
+			return fmt.Errorf("ipvs: %v", err)
+		}
+	} else {
+		if err := handle.NewService(svc); err != nil {
+			return fmt.Errorf("ipvs: %v", err)
+		}
+		logger.Info.Printf(b.logPrefix+"service: %s:%d created", svc.Address, svc.Port)
+	}
+
+	dests, err := handle.GetDestinations(svc)
+	if err != nil {
+		return fmt.Errorf("ipvs: %v", err)
+	}
+
+	// Wanted weight of each real server.
+	weights := map[string]int{}
+	for _, node := range lbPool.GetNodes() {
+		weights[node.IPAddress.String()] = 0
+		for _, want := range wantSet {
+			if want.Equal(node.IPAddress) {
+				weights[node.IPAddress.String()] = node.Weight
+			}
+		}
+	}
+
+	// Update or delete existing real servers.
+	for _, dest := range dests {
+		weight, ok := weights[dest.Address.String()]
+		if !ok {
+			logger.Debug.Printf(b.logPrefix+"service: %s:%d deleting: %s", svc.Address, svc.Port, dest.Address)
+			if err := handle.DelDestination(svc, dest); err != nil {
+				return fmt.Errorf("ipvs: %v", err)
+			}
+			continue
+		}
+		delete(weights, dest.Address.String())
+		if dest.Weight != weight {
+			logger.Debug.Printf(b.logPrefix+"service: %s:%d weight: %s %d", svc.Address, svc.Port, dest.Address, weight)
+			dest.Weight = weight
+			if err := handle.UpdateDestination(svc, dest); err != nil {
+				return fmt.Errorf("ipvs: %v", err)
+			}
+		}
+	}
+
+	// Add missing real servers, but only those which should get traffic.
+	for address, weight := range weights {
+		if weight == 0 {
+			continue
+		}
+		dest := &ipvs.Destination{
+			Address:         net.ParseIP(address),
+			Port:            nodePort,
+			Weight:          weight,
+			ConnectionFlags: forward,
+			AddressFamily:   svc.AddressFamily,
+		}
+		logger.Debug.Printf(b.logPrefix+"service: %s:%d adding: %s %d", svc.Address, svc.Port, address, weight)
+		if err := handle.NewDestination(svc, dest); err != nil {
+			return fmt.Errorf("ipvs: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package backend
+
+import (
+	"github.com/innogames/yacht/logger"
+)
+
+// newIPVS reports that IPVS backend is available only on Linux.
+func newIPVS(name string, json JSONMap) Backend {
+	logger.Error.Printf("backend: %s type: ipvs is supported only on Linux", name)
+	return nil
+}
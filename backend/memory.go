@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"net"
+	"sync"
+)
+
+// Memory stores all properties of memory backend. Sets are only kept in memory
+// and every change is logged. It is useful for testing and on systems without pf.
+type Memory struct {
+	sync.Mutex
+	name      string
+	logPrefix string
+	sets      map[string][]net.IP
+}
+
+// newMemory creates new memory backend.
+func newMemory(name string, json JSONMap) *Memory {
+	b := new(Memory)
+	b.name = name
+	b.logPrefix = "backend: " + name + " "
+	b.sets = map[string][]net.IP{}
+	logger.Info.Printf(b.logPrefix + "type: memory created")
+	return b
+}
+
+// GetSet returns addresses currently present in named set.
+func (b *Memory) GetSet(lbPool *lbpool.LBPool, name string) ([]net.IP, error) {
+	defer b.Unlock()
+	b.Lock()
+	return b.sets[name], nil
+}
+
+// SyncSet replaces content of named set.
+func (b *Memory) SyncSet(lbPool *lbpool.LBPool, name string, curSet []net.IP, wantSet []net.IP) error {
+	defer b.Unlock()
+	b.Lock()
+	addSet, delSet := Diff(curSet, wantSet)
+	logger.Info.Printf(b.logPrefix+"set: %s add: %s delete: %s", name, addSet, delSet)
+	b.sets[name] = wantSet
+	return nil
+}
@@ -0,0 +1,221 @@
+//go:build linux
+// +build linux
+
+package backend
+
+import (
+	"fmt"
+	"github.com/google/nftables"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"net"
+	"time"
+)
+
+// Nftables stores all properties of nftables backend. Sets are nftables sets
+// in a single table, managed over netlink.
+type Nftables struct {
+	name          string
+	logPrefix     string
+	table         *nftables.Table
+	driftInterval time.Duration
+
+	// Operation
+	conn      *nftables.Conn
+	applied   map[string]nftablesSet
+	lastDrift time.Time
+}
+
+// nftablesSet remembers what was applied to a set in order to detect drift.
+type nftablesSet struct {
+	lbPool  *lbpool.LBPool
+	wantSet []net.IP
+}
+
+// newNftables creates new nftables backend and populates it with data from JSON config.
+func newNftables(name string, json JSONMap) Backend {
+	b := new(Nftables)
+	b.name = name
+	b.logPrefix = "backend: " + name + " "
+	b.applied = map[string]nftablesSet{}
+	b.table = &nftables.Table{
+		Name:   "yacht",
+		Family: nftables.TableFamilyINet,
+	}
+	b.driftInterval = 10 * time.Second
+
+	if table, ok := json["table"].(string); ok {
+		b.table.Name = table
+	}
+	if family, ok := json["family"].(string); ok {
+		switch family {
+		case "inet":
+			b.table.Family = nftables.TableFamilyINet
+		case "ip":
+			b.table.Family = nftables.TableFamilyIPv4
+		case "ip6":
+			b.table.Family = nftables.TableFamilyIPv6
+		default:
+			logger.Error.Printf(b.logPrefix+"unknown family %s", family)
+			return nil
+		}
+	}
+	if driftInterval, ok := json["drift_interval"].(float64); ok && driftInterval > 0 {
+		b.driftInterval = time.Duration(driftInterval) * time.Second
+	}
+
+	logger.Info.Printf(b.logPrefix+"type: nftables table: %s created", b.table.Name)
+	return b
+}
+
+// getSet finds named set in table, returns nil if the set or the table does not exist.
+func (b *Nftables) getSet(conn *nftables.Conn, name string) *nftables.Set {
+	sets, err := conn.GetSets(b.table)
+	if err != nil {
+		return nil
+	}
+	for _, set := range sets {
+		if set.Name == name {
+			return set
+		}
+	}
+	return nil
+}
+
+// GetSet returns addresses currently present in nftables set.
+func (b *Nftables) GetSet(lbPool *lbpool.LBPool, name string) ([]net.IP, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+
+	set := b.getSet(conn, name)
+	if set == nil {
+		return nil, nil
+	}
+
+	elements, err := conn.GetSetElements(set)
+	if err != nil {
+		return nil, fmt.Errorf("nftables: %v", err)
+	}
+
+	var ret []net.IP
+	for _, element := range elements {
+		ret = append(ret, net.IP(append([]byte{}, element.Key...)))
+	}
+	return ret, nil
+}
+
+// SyncSet queues changes of nftables set into the running batch. The set,
+// and the table if needed, is created if it does not exist yet.
+func (b *Nftables) SyncSet(lbPool *lbpool.LBPool, name string, curSet []net.IP, wantSet []net.IP) error {
+	if b.conn == nil {
+		return fmt.Errorf("nftables: changes must be done in a batch")
+	}
+
+	set := b.getSet(b.conn, name)
+	if set == nil {
+		set = &nftables.Set{
+			Table:   b.table,
+			Name:    name,
+			KeyType: nftables.TypeIPAddr,
+		}
+		if lbPool.GetProto() == "6" {
+			set.KeyType = nftables.TypeIP6Addr
+		}
+		b.conn.AddTable(b.table)
+		if err := b.conn.AddSet(set, nftablesElements(wantSet)); err != nil {
+			return fmt.Errorf("nftables: %v", err)
+		}
+		logger.Info.Printf(b.logPrefix+"set: %s created with: %s", name, wantSet)
+	} else {
+		addSet, delSet := Diff(curSet, wantSet)
+		if len(addSet) > 0 {
+			if err := b.conn.SetAddElements(set, nftablesElements(addSet)); err != nil {
+				return fmt.Errorf("nftables: %v", err)
+			}
+		}
+		if len(delSet) > 0 {
+			if err := b.conn.SetDeleteElements(set, nftablesElements(delSet)); err != nil {
+				return fmt.Errorf("nftables: %v", err)
+			}
+		}
+		logger.Debug.Printf(b.logPrefix+"set: %s add: %s delete: %s", name, addSet, delSet)
+	}
+
+	b.applied[name] = nftablesSet{lbPool, wantSet}
+	return nil
+}
+
+// nftablesElements converts addresses to elements of nftables set.
+func nftablesElements(ipAddresses []net.IP) []nftables.SetElement {
+	var elements []nftables.SetElement
+	for _, ipAddress := range ipAddresses {
+		key := ipAddress.To4()
+		if key == nil {
+			key = ipAddress.To16()
+		}
+		elements = append(elements, nftables.SetElement{Key: key})
+	}
+	return elements
+}
+
+// Begin starts a new batch of changes.
+func (b *Nftables) Begin() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables: %v", err)
+	}
+	b.conn = conn
+	return nil
+}
+
+// Commit applies all changes of the batch atomically.
+func (b *Nftables) Commit() error {
+	defer func() { b.conn = nil }()
+	if err := b.conn.Flush(); err != nil {
+		// Nothing was applied, let the next drift check retry it.
+		b.lastDrift = time.Time{}
+		return fmt.Errorf("nftables: %v", err)
+	}
+	return nil
+}
+
+// Rollback throws away all changes of the batch.
+func (b *Nftables) Rollback() {
+	b.conn = nil
+}
+
+// Tick periodically compares content of nftables sets with what was applied
+// to them and corrects them if someone has changed them by hand.
+func (b *Nftables) Tick() {
+	if time.Since(b.lastDrift) < b.driftInterval {
+		return
+	}
+	b.lastDrift = time.Now()
+
+	for name, applied := range b.applied {
+		curSet, err := b.GetSet(applied.lbPool, name)
+		if err != nil {
+			logger.Error.Printf(b.logPrefix + err.Error())
+			continue
+		}
+		addSet, delSet := Diff(curSet, applied.wantSet)
+		if len(addSet) == 0 && len(delSet) == 0 {
+			continue
+		}
+		logger.Warning.Printf(b.logPrefix+"set: %s drift detected missing: %s unexpected: %s action: correct", name, addSet, delSet)
+		if err := b.Begin(); err != nil {
+			logger.Error.Printf(b.logPrefix + err.Error())
+			continue
+		}
+		if err := b.SyncSet(applied.lbPool, name, curSet, applied.wantSet); err != nil {
+			logger.Error.Printf(b.logPrefix + err.Error())
+			b.Rollback()
+			continue
+		}
+		if err := b.Commit(); err != nil {
+			logger.Error.Printf(b.logPrefix + err.Error())
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package backend
+
+import (
+	"github.com/innogames/yacht/logger"
+)
+
+// newNftables reports that nftables backend is available only on Linux.
+func newNftables(name string, json JSONMap) Backend {
+	logger.Error.Printf("backend: %s type: nftables is supported only on Linux", name)
+	return nil
+}
@@ -0,0 +1,166 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"net"
+	"strings"
+)
+
+// PF stores all properties of pf backend. Sets are pf tables managed with pfctl.
+// In a transaction changes of all tables are collected and loaded at once.
+type PF struct {
+	name         string
+	logPrefix    string
+	anchor       string
+	pfctl        PFctlExecutor
+	foreign      map[string]bool
+	pendingKills []pendingKill
+	batch        []pfBatchEntry
+	inBatch      bool
+}
+
+// pfBatchEntry is a change of a single table waiting for Commit.
+type pfBatchEntry struct {
+	lbPool  *lbpool.LBPool
+	table   string
+	wantSet []net.IP
+	addSet  []net.IP
+	delSet  []net.IP
+}
+
+// newPF creates new pf backend and populates it with data from JSON config.
+func newPF(name string, json JSONMap) *PF {
+	b := new(PF)
+	b.name = name
+	b.logPrefix = "backend: " + name + " "
+	path, _ := json["pfctl"].(string)
+	if path == "" {
+		path = defaultPFctlPath
+	}
+	b.pfctl = localPFctl{path}
+	if pfctlExecutor != nil {
+		b.pfctl = pfctlExecutor
+	}
+	b.anchor, _ = json["anchor"].(string)
+	b.foreign = map[string]bool{}
+	b.pendingKills = pfPendingKills[name]
+	delete(pfPendingKills, name)
+	logger.Info.Printf(b.logPrefix+"type: pf pfctl: %s anchor: %s created", path, b.anchor)
+	return b
+}
+
+// GetSet returns addresses currently present in pf table. Table containing
+// other entries, like prefixes, is remembered so that SyncSet replaces it.
+func (b *PF) GetSet(lbPool *lbpool.LBPool, name string) ([]net.IP, error) {
+	entries, err := b.pfctl.ShowTable(b.anchor, name)
+	if err != nil {
+		return nil, err
+	}
+	var ret []net.IP
+	b.foreign[name] = false
+	for _, entry := range entries {
+		if ipAddress := net.ParseIP(entry); ipAddress != nil {
+			ret = append(ret, ipAddress)
+		} else {
+			b.foreign[name] = true
+		}
+	}
+	logger.Debug.Printf("have in %s: %s", name, entries)
+	return ret, nil
+}
+
+// SyncSet changes content of pf table and kills states to removed nodes
+// if LB Pool is configured to do so. In a transaction the change is only
+// remembered until Commit.
+func (b *PF) SyncSet(lbPool *lbpool.LBPool, name string, curSet []net.IP, wantSet []net.IP) error {
+	logger.Debug.Printf("want in %s: %s", name, wantSet)
+
+	addSet, delSet := Diff(curSet, wantSet)
+	if len(addSet) == 0 && len(delSet) == 0 && b.foreign[name] == false {
+		return nil
+	}
+
+	if b.inBatch {
+		b.batch = append(b.batch, pfBatchEntry{lbPool, name, wantSet, addSet, delSet})
+		return nil
+	}
+
+	if err := b.pfctl.ReplaceTable(b.anchor, name, wantSet); err != nil {
+		return err
+	}
+
+	b.killStates(lbPool, name, addSet, delSet)
+	return nil
+}
+
+// Begin starts collecting changes of tables.
+func (b *PF) Begin() error {
+	b.batch = nil
+	b.inBatch = true
+	return nil
+}
+
+// Commit loads all collected tables in a single atomic pfctl run. If that
+// fails, tables are changed one by one instead and all tables which failed
+// are reported together with their LB Pools in CommitError. States are
+// killed only for changed tables.
+func (b *PF) Commit() error {
+	batch := b.batch
+	b.batch = nil
+	b.inBatch = false
+
+	if len(batch) == 0 {
+		return nil
+	}
+	tables := map[string][]net.IP{}
+	for _, entry := range batch {
+		tables[entry.table] = entry.wantSet
+	}
+
+	changed := batch
+	var failed []string
+	var failedPools []*lbpool.LBPool
+	if err := b.pfctl.LoadTables(b.anchor, tables); err != nil {
+		logger.Warning.Printf(b.logPrefix+"loading %d tables at once failed, changing them one by one: %v", len(tables), err)
+		changed = nil
+		for _, entry := range batch {
+			if err := b.pfctl.ReplaceTable(b.anchor, entry.table, entry.wantSet); err != nil {
+				logger.Error.Printf("%s%v", entry.lbPool.GetLogPrefix(), err)
+				failed = append(failed, entry.table)
+				failedPools = append(failedPools, entry.lbPool)
+				continue
+			}
+			changed = append(changed, entry)
+		}
+	}
+
+	for _, entry := range changed {
+		b.killStates(entry.lbPool, entry.table, entry.addSet, entry.delSet)
+	}
+	if len(failed) > 0 {
+		return CommitError{failedPools, fmt.Errorf("pf: changing tables %s failed", strings.Join(failed, ", "))}
+	}
+	return nil
+}
+
+// Rollback drops collected changes of tables.
+func (b *PF) Rollback() {
+	b.batch = nil
+	b.inBatch = false
+}
+
+// Close hands pending kills over to pf backend of the same name created on
+// configuration reload, so that removed nodes still get their states killed.
+func (b *PF) Close() {
+	if len(b.pendingKills) > 0 {
+		pfPendingKills[b.name] = b.pendingKills
+	}
+	b.pendingKills = nil
+}
+
+// Tick kills states of removed nodes whose grace period is over.
+func (b *PF) Tick() {
+	b.doPendingKills()
+}
@@ -0,0 +1,249 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Syntax of pf rules differs between systems. FreeBSD has separate rdr
+// rules evaluated from rdr-anchor, OpenBSD redirects with rdr-to option
+// of pass rules.
+const (
+	PFSyntaxFreeBSD = "freebsd"
+	PFSyntaxOpenBSD = "openbsd"
+)
+
+// pfSystemSyntax returns syntax of pf rules of the system we run on.
+func pfSystemSyntax() string {
+	if runtime.GOOS == "openbsd" {
+		return PFSyntaxOpenBSD
+	}
+	return PFSyntaxFreeBSD
+}
+
+// Prepare loads anchor owned by pf backend with tables and rules of all
+// its LB Pools. Current content of tables is kept. Tables of LB Pools which
+// are not configured anymore are removed. Without anchor nothing is done,
+// tables and rules are then expected to be in pf.conf.
+//
+// The main ruleset must evaluate the anchor. On OpenBSD it needs:
+//
+//	anchor "<anchor>"
+//
+// On FreeBSD rdr rules need also:
+//
+//	rdr-anchor "<anchor>"
+//
+// Missing lines are reported after anchor is loaded.
+func (b *PF) Prepare(lbPools []*lbpool.LBPool) error {
+	if b.anchor == "" {
+		return nil
+	}
+	local, ok := b.pfctl.(localPFctl)
+	if !ok {
+		return fmt.Errorf("anchor: %s can not be loaded with privilege separation", b.anchor)
+	}
+
+	entries := map[string][]string{}
+	for _, lbPool := range lbPools {
+		table := lbPool.GetPFName()
+		tableEntries, err := local.ShowTable(b.anchor, table)
+		if err != nil {
+			return err
+		}
+		entries[table] = tableEntries
+	}
+
+	syntax := pfSystemSyntax()
+	ruleset, err := pfRuleset(lbPools, entries, "", syntax)
+	if err != nil {
+		return err
+	}
+
+	logger.Debug.Printf(b.logPrefix+"anchor: %s loading:\n%s", b.anchor, ruleset)
+	if _, err := local.pfctlCmdInput(pfctlAnchorArgs(b.anchor, "-f", "-"), ruleset); err != nil {
+		return err
+	}
+	logger.Info.Printf(b.logPrefix+"anchor: %s loaded with %d tables", b.anchor, len(entries))
+
+	// Anchor is owned by this backend, so any other table in it is a leftover.
+	out, err := local.pfctlCmd(pfctlAnchorArgs(b.anchor, "-sTables"))
+	if err != nil {
+		return err
+	}
+	for out.Scan() {
+		table := strings.TrimSpace(out.Text())
+		if _, ok := entries[table]; ok || table == "" {
+			continue
+		}
+		logger.Info.Printf(b.logPrefix+"anchor: %s removing table: %s", b.anchor, table)
+		if _, err := local.pfctlCmd(pfctlAnchorArgs(b.anchor, "-t", table, "-T", "kill")); err != nil {
+			return err
+		}
+	}
+
+	return b.checkAnchorLines(local, pfAnchorLines(b.anchor, ruleset))
+}
+
+// pfAnchorLines returns lines which must be present in the main ruleset for
+// rules loaded into anchor to be evaluated.
+func pfAnchorLines(anchor string, ruleset string) []string {
+	lines := []string{fmt.Sprintf("anchor %q", anchor)}
+	for _, line := range strings.Split(ruleset, "\n") {
+		if strings.HasPrefix(line, "rdr ") {
+			lines = append(lines, fmt.Sprintf("rdr-anchor %q", anchor))
+			break
+		}
+	}
+	return lines
+}
+
+// checkAnchorLines verifies that main ruleset contains given anchor lines.
+// Rules are shown by pfctl -sr, FreeBSD shows rdr-anchor with pfctl -sn.
+func (b *PF) checkAnchorLines(local localPFctl, lines []string) error {
+	var shown []string
+	for _, show := range []string{"-sr", "-sn"} {
+		if show == "-sn" && len(lines) == 1 {
+			break
+		}
+		out, err := local.pfctlCmd([]string{show})
+		if err != nil {
+			return err
+		}
+		for out.Scan() {
+			shown = append(shown, strings.TrimSpace(out.Text()))
+		}
+	}
+
+	var missing []string
+	for _, line := range lines {
+		found := false
+		for _, rule := range shown {
+			if rule == line || strings.HasPrefix(rule, line+" ") {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			missing = append(missing, line)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("anchor: %s is not evaluated, add to pf.conf: %s", b.anchor, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// PFConf returns pf.conf fragment with tables of all LB Pools and their rules
+// in given syntax, or in syntax of this system if it is empty. LB Pools
+// without rules configured get an example rdr rule.
+func PFConf(lbPools []*lbpool.LBPool, syntax string) (string, error) {
+	if syntax == "" {
+		syntax = pfSystemSyntax()
+	}
+	if syntax != PFSyntaxFreeBSD && syntax != PFSyntaxOpenBSD {
+		return "", fmt.Errorf("pf: unknown syntax %s", syntax)
+	}
+	sorted := append([]*lbpool.LBPool{}, lbPools...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].GetPFName() < sorted[j].GetPFName()
+	})
+	return pfRuleset(sorted, nil, "rdr", syntax)
+}
+
+// pfRuleset generates table definitions with given entries followed by rules
+// of all LB Pools. FreeBSD requires rdr rules before filter rules.
+func pfRuleset(lbPools []*lbpool.LBPool, entries map[string][]string, defaultRules string, syntax string) (string, error) {
+	var tables, rdrRules, rules bytes.Buffer
+	for _, lbPool := range lbPools {
+		table := lbPool.GetPFName()
+		fmt.Fprintf(&tables, "table <%s> persist", table)
+		if len(entries[table]) > 0 {
+			fmt.Fprintf(&tables, " { %s }", strings.Join(entries[table], " "))
+		}
+		tables.WriteString("\n")
+
+		rule, err := pfRules(lbPool, table, defaultRules, syntax)
+		if err != nil {
+			return "", fmt.Errorf("%s%v", lbPool.GetLogPrefix(), err)
+		}
+		if strings.HasPrefix(rule, "rdr ") {
+			rdrRules.WriteString(rule)
+		} else {
+			rules.WriteString(rule)
+		}
+	}
+	return tables.String() + rdrRules.String() + rules.String(), nil
+}
+
+// pfRules generates pf rules of LB Pool from its backend options in given
+// syntax. Option rules selects "rdr", "route-to" or "pass" rules, none are
+// generated without it. Rules of defaultRules type are used if option is
+// missing. Traffic is matched by protocol ("tcp" by default) and list of
+// ports (all if empty). Rdr rules can change port to node_port. Route-to
+// rules on FreeBSD require interface towards LB Nodes.
+func pfRules(lbPool *lbpool.LBPool, table string, defaultRules string, syntax string) (string, error) {
+	options := lbPool.GetBackendOptions()
+	ruleType, ok := options["rules"].(string)
+	if !ok {
+		ruleType = defaultRules
+	}
+	if ruleType == "" {
+		return "", nil
+	}
+
+	af := "inet"
+	if lbPool.GetProto() == "6" {
+		af = "inet6"
+	}
+	protocol := "tcp"
+	if p, ok := options["protocol"].(string); ok {
+		if p != "tcp" && p != "udp" {
+			return "", fmt.Errorf("pf: unknown protocol %s", p)
+		}
+		protocol = p
+	}
+
+	var ports []string
+	if portsConfig, ok := options["ports"].([]interface{}); ok {
+		for _, port := range portsConfig {
+			if p, ok := port.(float64); ok && p > 0 && p <= 65535 {
+				ports = append(ports, fmt.Sprintf("%d", int(p)))
+			}
+		}
+	}
+	to := fmt.Sprintf("to %s", lbPool.GetIPAddress())
+	if len(ports) > 0 {
+		to += fmt.Sprintf(" port { %s }", strings.Join(ports, " "))
+	}
+	match := fmt.Sprintf("%s proto %s from any %s", af, protocol, to)
+
+	switch ruleType {
+	case "rdr":
+		redirect := fmt.Sprintf("<%s>", table)
+		if nodePort, ok := options["node_port"].(float64); ok && nodePort > 0 && nodePort <= 65535 {
+			redirect += fmt.Sprintf(" port %d", int(nodePort))
+		}
+		if syntax == PFSyntaxOpenBSD {
+			return fmt.Sprintf("pass in quick %s rdr-to %s round-robin\n", match, redirect), nil
+		}
+		return fmt.Sprintf("rdr pass %s -> %s round-robin\n", match, redirect), nil
+	case "route-to":
+		if syntax == PFSyntaxOpenBSD {
+			return fmt.Sprintf("pass in quick %s route-to <%s> round-robin\n", match, table), nil
+		}
+		iface, _ := options["interface"].(string)
+		if iface == "" {
+			return "", fmt.Errorf("pf: interface is required for route-to rules")
+		}
+		return fmt.Sprintf("pass in quick route-to (%s <%s>) round-robin %s keep state\n", iface, table, match), nil
+	case "pass":
+		return fmt.Sprintf("pass in quick %s keep state\n", match), nil
+	}
+	return "", fmt.Errorf("pf: unknown rules %s", ruleType)
+}
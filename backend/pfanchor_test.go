@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"reflect"
+	"testing"
+)
+
+func newRulesLBPool(proto string, options map[string]interface{}) *lbpool.LBPool {
+	return lbpool.NewLBPool(proto, "web", map[string]interface{}{
+		"ip4":             "192.0.2.1",
+		"ip6":             "2001:db8::1",
+		"pf_name":         "web",
+		"backend_options": options,
+		"healthchecks":    []interface{}{},
+		"nodes":           map[string]interface{}{},
+	})
+}
+
+func TestPFRules(t *testing.T) {
+	logger.InitLoggers(false)
+
+	for _, tc := range []struct {
+		proto   string
+		options map[string]interface{}
+		syntax  string
+		want    string
+	}{
+		{
+			"4", map[string]interface{}{"rules": "rdr", "ports": []interface{}{80.0, 443.0}, "node_port": 8080.0},
+			PFSyntaxFreeBSD,
+			"rdr pass inet proto tcp from any to 192.0.2.1 port { 80 443 } -> <web_4> port 8080 round-robin\n",
+		},
+		{
+			"4", map[string]interface{}{"rules": "rdr", "ports": []interface{}{80.0, 443.0}, "node_port": 8080.0},
+			PFSyntaxOpenBSD,
+			"pass in quick inet proto tcp from any to 192.0.2.1 port { 80 443 } rdr-to <web_4> port 8080 round-robin\n",
+		},
+		{
+			"6", map[string]interface{}{"rules": "route-to", "interface": "em1", "protocol": "udp"},
+			PFSyntaxFreeBSD,
+			"pass in quick route-to (em1 <web_6>) round-robin inet6 proto udp from any to 2001:db8::1 keep state\n",
+		},
+		{
+			"6", map[string]interface{}{"rules": "route-to", "protocol": "udp"},
+			PFSyntaxOpenBSD,
+			"pass in quick inet6 proto udp from any to 2001:db8::1 route-to <web_6> round-robin\n",
+		},
+		{
+			"4", map[string]interface{}{"rules": "pass", "ports": []interface{}{53.0}},
+			PFSyntaxOpenBSD,
+			"pass in quick inet proto tcp from any to 192.0.2.1 port { 53 } keep state\n",
+		},
+		{
+			"4", map[string]interface{}{},
+			PFSyntaxFreeBSD,
+			"",
+		},
+	} {
+		lbPool := newRulesLBPool(tc.proto, tc.options)
+		got, err := pfRules(lbPool, lbPool.GetPFName(), "", tc.syntax)
+		if err != nil {
+			t.Errorf("%s %v: %v", tc.syntax, tc.options, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s %v:\ngot  %q\nwant %q", tc.syntax, tc.options, got, tc.want)
+		}
+	}
+
+	lbPool := newRulesLBPool("4", map[string]interface{}{"rules": "route-to"})
+	if _, err := pfRules(lbPool, lbPool.GetPFName(), "", PFSyntaxFreeBSD); err == nil {
+		t.Error("route-to without interface accepted on FreeBSD")
+	}
+}
+
+func TestPFConf(t *testing.T) {
+	logger.InitLoggers(false)
+
+	lbPools := []*lbpool.LBPool{
+		newRulesLBPool("4", map[string]interface{}{"rules": "pass"}),
+		newRulesLBPool("6", map[string]interface{}{}),
+	}
+	conf, err := PFConf(lbPools, PFSyntaxFreeBSD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// FreeBSD wants translation rules before filter rules.
+	want := "table <web_4> persist\n" +
+		"table <web_6> persist\n" +
+		"rdr pass inet6 proto tcp from any to 2001:db8::1 -> <web_6> round-robin\n" +
+		"pass in quick inet proto tcp from any to 192.0.2.1 keep state\n"
+	if conf != want {
+		t.Errorf("got:\n%swant:\n%s", conf, want)
+	}
+
+	if _, err := PFConf(lbPools, "linux"); err == nil {
+		t.Error("unknown syntax accepted")
+	}
+}
+
+func TestPFAnchorLines(t *testing.T) {
+	rdr := "table <web_4> persist\nrdr pass inet proto tcp from any to 192.0.2.1 -> <web_4> round-robin\n"
+	if got := pfAnchorLines("yacht", rdr); reflect.DeepEqual(got, []string{`anchor "yacht"`, `rdr-anchor "yacht"`}) == false {
+		t.Errorf("FreeBSD rdr rules need %q", got)
+	}
+	pass := "table <web_4> persist\npass in quick inet proto tcp from any to 192.0.2.1 rdr-to <web_4> round-robin\n"
+	if got := pfAnchorLines("yacht", pass); reflect.DeepEqual(got, []string{`anchor "yacht"`}) == false {
+		t.Errorf("pass rules need %q", got)
+	}
+}
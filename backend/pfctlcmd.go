@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/innogames/yacht/logger"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+type pfctlError struct {
+	s string
+}
+
+func (e pfctlError) Error() string {
+	return "pfctl: " + e.s
+}
+
+func (l localPFctl) pfctlCmd(args []string) (*bufio.Scanner, error) {
+	return l.pfctlCmdInput(args, "")
+}
+
+// pfctlCmdInput runs pfctl with given input, used for loading rules from stdin.
+func (l localPFctl) pfctlCmdInput(args []string, input string) (*bufio.Scanner, error) {
+	args = append([]string{"-q"}, args...)
+	cmd := exec.Command(l.path, args...)
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+	out, err := cmd.CombinedOutput()
+
+	outStr := string(out)
+
+	if err != nil {
+		return nil, pfctlError{err.Error() + "\n" + outStr}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(outStr))
+
+	return scanner, nil
+}
+
+// pfctlAnchorArgs prepends anchor to pfctl arguments, if anchor is used.
+func pfctlAnchorArgs(anchor string, args ...string) []string {
+	if anchor == "" {
+		return args
+	}
+	return append([]string{"-a", anchor}, args...)
+}
+
+// pfctlEntry normalizes entry of pf table. Host prefixes are stored by pf
+// as plain addresses, other prefixes stay in CIDR notation.
+func pfctlEntry(entry string) string {
+	entry = strings.TrimSpace(entry)
+	negate := strings.HasPrefix(entry, "!")
+	entry = strings.TrimPrefix(entry, "!")
+
+	if ipAddress, ipNet, err := net.ParseCIDR(entry); err == nil {
+		ones, bits := ipNet.Mask.Size()
+		if ones == bits {
+			entry = ipAddress.String()
+		} else {
+			entry = ipNet.String()
+		}
+	} else if ipAddress := net.ParseIP(entry); ipAddress != nil {
+		entry = ipAddress.String()
+	}
+
+	if negate {
+		return "!" + entry
+	}
+	return entry
+}
+
+// ShowTable returns all normalized entries of pf table, including
+// prefixes. Table which does not exist is empty.
+func (l localPFctl) ShowTable(anchor string, table string) ([]string, error) {
+	var ret []string
+
+	out, err := l.pfctlCmd(pfctlAnchorArgs(anchor, "-t", table, "-Ts"))
+	if err != nil {
+		if strings.Contains(err.Error(), "Table does not exist") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for out.Scan() {
+		if entry := pfctlEntry(out.Text()); entry != "" {
+			ret = append(ret, entry)
+		}
+	}
+
+	return ret, nil
+}
+
+// ReplaceTable sets content of pf table to exactly given addresses in a single
+// pfctl run, creating the table if needed. Table is read back to verify the result.
+func (l localPFctl) ReplaceTable(anchor string, table string, ipAddresses []net.IP) error {
+	logger.Debug.Printf("replacing %s: %s", table, ipAddresses)
+	cmd := pfctlAnchorArgs(anchor, "-t", table, "-T", "replace")
+	want := map[string]bool{}
+	for _, ipAddress := range ipAddresses {
+		cmd = append(cmd, ipAddress.String())
+		want[ipAddress.String()] = true
+	}
+	if len(ipAddresses) == 0 {
+		// Without addresses replace would read them from stdin.
+		cmd = append(cmd, "-f", "/dev/null")
+	}
+	if _, err := l.pfctlCmd(cmd); err != nil {
+		return err
+	}
+
+	entries, err := l.ShowTable(anchor, table)
+	if err != nil {
+		return err
+	}
+	ok := len(entries) == len(want)
+	for _, entry := range entries {
+		if want[entry] == false {
+			ok = false
+		}
+	}
+	if ok == false {
+		sort.Strings(entries)
+		return pfctlError{fmt.Sprintf("table %s verification failed, has: %s", table, strings.Join(entries, " "))}
+	}
+	return nil
+}
+
+// LoadTables replaces content of all given tables in a single pfctl run.
+// Only table definitions are loaded, which pf applies atomically.
+func (l localPFctl) LoadTables(anchor string, tables map[string][]net.IP) error {
+	var rules bytes.Buffer
+	for table, ipAddresses := range tables {
+		fmt.Fprintf(&rules, "table <%s> persist", table)
+		if len(ipAddresses) > 0 {
+			rules.WriteString(" {")
+			for _, ipAddress := range ipAddresses {
+				rules.WriteString(" " + ipAddress.String())
+			}
+			rules.WriteString(" }")
+		}
+		rules.WriteString("\n")
+	}
+	logger.Debug.Printf("loading tables:\n%s", rules.String())
+	_, err := l.pfctlCmdInput(pfctlAnchorArgs(anchor, "-Tl", "-f", "-"), rules.String())
+	return err
+}
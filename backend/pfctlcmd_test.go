@@ -0,0 +1,221 @@
+package backend
+
+import (
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakePFctlScript keeps each pf table in a file next to the script. Address
+// written into file "drop" is silently left out by replace, like pf would do
+// with an address it refuses. Replacing table with file "fail.<table>" fails.
+const fakePFctlScript = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" >> "$dir/log"
+[ "$1" = -q ] && shift
+[ "$1" = -a ] && shift 2
+case "$1" in -k|-K) exit 0;; esac
+[ "$1" = -t ] || exit 2
+name=$2
+table="$dir/table.$name"
+shift 2
+case "$1" in
+-Ts)
+	[ -f "$table" ] || { echo "pfctl: Table does not exist."; exit 1; }
+	cat "$table";;
+-T)
+	[ "$2" = replace ] || exit 2
+	[ -f "$dir/fail.$name" ] && exit 1
+	shift 2
+	: > "$table"
+	for a in "$@"; do
+		[ "$a" = -f ] && break
+		[ -f "$dir/drop" ] && [ "$a" = "$(cat "$dir/drop")" ] && continue
+		echo "   $a" >> "$table"
+	done;;
+*)
+	exit 2;;
+esac
+`
+
+// newFakePFctl creates fake pfctl binary and returns it with its directory.
+func newFakePFctl(t *testing.T) (localPFctl, string) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pfctl")
+	if err := ioutil.WriteFile(path, []byte(fakePFctlScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return localPFctl{path}, dir
+}
+
+func TestPFctlEntry(t *testing.T) {
+	for entry, want := range map[string]string{
+		"   192.0.2.5":      "192.0.2.5",
+		"   192.0.2.5/32":   "192.0.2.5",
+		"192.0.2.0/24":      "192.0.2.0/24",
+		"192.0.2.7/24":      "192.0.2.0/24",
+		"2001:db8::1/128":   "2001:db8::1",
+		"2001:0db8::0/64":   "2001:db8::/64",
+		"  !10.0.0.0/8":     "!10.0.0.0/8",
+		"2001:db8:0:0::1":   "2001:db8::1",
+		"   not-an-address": "not-an-address",
+	} {
+		if got := pfctlEntry(entry); got != want {
+			t.Errorf("pfctlEntry(%q) = %q, want %q", entry, got, want)
+		}
+	}
+}
+
+func TestPFctlShowTable(t *testing.T) {
+	logger.InitLoggers(false)
+	pfctl, dir := newFakePFctl(t)
+
+	entries, err := pfctl.ShowTable("", "missing")
+	if err != nil || entries != nil {
+		t.Fatalf("missing table: %v %v", entries, err)
+	}
+
+	table := "   192.0.2.5/32\n   2001:0db8::1\n  !10.0.0.0/8\n   192.0.2.0/24\n\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "table.web_4"), []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = pfctl.ShowTable("yacht", "web_4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.5", "2001:db8::1", "!10.0.0.0/8", "192.0.2.0/24"}
+	if reflect.DeepEqual(entries, want) == false {
+		t.Errorf("ShowTable = %q, want %q", entries, want)
+	}
+
+	log, _ := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if strings.Contains(string(log), "-q -a yacht -t web_4 -Ts") == false {
+		t.Errorf("pfctl called with:\n%s", log)
+	}
+}
+
+func TestPFctlReplaceTable(t *testing.T) {
+	logger.InitLoggers(false)
+	pfctl, dir := newFakePFctl(t)
+
+	ipAddresses := []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("192.0.2.11")}
+	if err := pfctl.ReplaceTable("", "web_4", ipAddresses); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := pfctl.ShowTable("", "web_4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(entries)
+	if reflect.DeepEqual(entries, []string{"192.0.2.10", "192.0.2.11"}) == false {
+		t.Errorf("table has %q", entries)
+	}
+
+	// Empty table must not make pfctl read addresses from stdin.
+	if err := pfctl.ReplaceTable("", "web_4", nil); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := pfctl.ShowTable("", "web_4"); len(entries) != 0 {
+		t.Errorf("table has %q", entries)
+	}
+	log, _ := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if strings.Contains(string(log), "-t web_4 -T replace -f /dev/null") == false {
+		t.Errorf("pfctl called with:\n%s", log)
+	}
+
+	// Address which did not make it into table is found by read-back.
+	if err := ioutil.WriteFile(filepath.Join(dir, "drop"), []byte("192.0.2.11"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = pfctl.ReplaceTable("", "web_4", ipAddresses)
+	if err == nil || strings.Contains(err.Error(), "verification failed") == false {
+		t.Errorf("verification error not reported: %v", err)
+	}
+}
+
+func TestPFctlKillStates(t *testing.T) {
+	logger.InitLoggers(false)
+	pfctl, dir := newFakePFctl(t)
+
+	if err := pfctl.KillStates(lbpool.KillStates, net.ParseIP("192.0.2.10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pfctl.KillStates(lbpool.KillSources, net.ParseIP("2001:db8::10")); err != nil {
+		t.Fatal(err)
+	}
+	log, _ := ioutil.ReadFile(filepath.Join(dir, "log"))
+	want := "-q -k 0.0.0.0/0 -k 192.0.2.10\n-q -K ::/0 -K 2001:db8::10\n"
+	if string(log) != want {
+		t.Errorf("pfctl called with:\n%swant:\n%s", log, want)
+	}
+}
+
+func TestPFctlFailure(t *testing.T) {
+	logger.InitLoggers(false)
+	pfctl, _ := newFakePFctl(t)
+
+	// Fake pfctl knows nothing about loading rules.
+	if err := pfctl.LoadTables("", map[string][]net.IP{"web_4": nil}); err == nil {
+		t.Error("failure of pfctl not reported")
+	}
+	if err := (localPFctl{"/nonexistent/pfctl"}).ReplaceTable("", "web_4", nil); err == nil {
+		t.Error("missing pfctl not reported")
+	}
+}
+
+func TestPFCommitPartialFailure(t *testing.T) {
+	logger.InitLoggers(false)
+	pfctl, dir := newFakePFctl(t)
+	b := newPF("pf", JSONMap{"pfctl": pfctl.path})
+
+	// Fake pfctl can not load tables at once, so they are replaced one by one.
+	if err := ioutil.WriteFile(filepath.Join(dir, "fail.api_4"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	web := newRulesLBPool("4", map[string]interface{}{})
+	api := lbpool.NewLBPool("4", "api", map[string]interface{}{
+		"ip4":          "192.0.2.2",
+		"pf_name":      "api",
+		"healthchecks": []interface{}{},
+		"nodes":        map[string]interface{}{},
+	})
+	wantSet := []net.IP{net.ParseIP("192.0.2.10")}
+
+	b.Begin()
+	for _, lbPool := range []*lbpool.LBPool{web, api} {
+		if err := b.SyncSet(lbPool, lbPool.GetPFName(), nil, wantSet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := b.Commit()
+	commitErr, ok := err.(CommitError)
+	if !ok {
+		t.Fatalf("Commit returned %v, want CommitError", err)
+	}
+	if len(commitErr.Failed) != 1 || commitErr.Failed[0] != api {
+		t.Errorf("failed LB Pools %v, want only api", commitErr.Failed)
+	}
+	if entries, _ := pfctl.ShowTable("", "web_4"); reflect.DeepEqual(entries, []string{"192.0.2.10"}) == false {
+		t.Errorf("table web_4 has %q", entries)
+	}
+}
+
+func TestPFPath(t *testing.T) {
+	logger.InitLoggers(false)
+	pfctl, _ := newFakePFctl(t)
+
+	custom := newPF("custom", JSONMap{"pfctl": pfctl.path})
+	standard := newPF("standard", JSONMap{})
+	if custom.pfctl != pfctl {
+		t.Errorf("custom backend uses %v", custom.pfctl)
+	}
+	if standard.pfctl != (localPFctl{defaultPFctlPath}) {
+		t.Errorf("standard backend uses %v", standard.pfctl)
+	}
+}
@@ -0,0 +1,42 @@
+package backend
+
+import (
+	"net"
+)
+
+// PFctlExecutor performs operations on pf tables. By default they are performed
+// by this process. With privilege separation they are sent to a privileged helper.
+type PFctlExecutor interface {
+	ShowTable(anchor string, table string) ([]string, error)
+	ReplaceTable(anchor string, table string, ipAddresses []net.IP) error
+	LoadTables(anchor string, tables map[string][]net.IP) error
+	KillStates(mode string, ipAddress net.IP) error
+}
+
+// defaultPFctlPath is location of pfctl binary unless pf backend configures
+// another one.
+const defaultPFctlPath = "/sbin/pfctl"
+
+// localPFctl runs pfctl binary at path directly.
+type localPFctl struct {
+	path string
+}
+
+// pfctlExecutor, if set, performs operations on pf tables of all pf backends
+// instead of running pfctl directly.
+var pfctlExecutor PFctlExecutor
+
+// LocalPFctl returns PFctlExecutor running pfctl binary at given path directly,
+// or at the default one if path is empty. It is used by the privileged helper.
+func LocalPFctl(path string) PFctlExecutor {
+	if path == "" {
+		path = defaultPFctlPath
+	}
+	return localPFctl{path}
+}
+
+// SetPFctlExecutor makes pf backends perform operations on pf tables with
+// given PFctlExecutor. It must be called before backends are created.
+func SetPFctlExecutor(executor PFctlExecutor) {
+	pfctlExecutor = executor
+}
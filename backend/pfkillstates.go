@@ -0,0 +1,103 @@
+package backend
+
+import (
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"net"
+	"time"
+)
+
+// pendingKill is a kill of states to node removed from table which waits
+// for grace period to let existing connections finish.
+type pendingKill struct {
+	table     string
+	ipAddress net.IP
+	mode      string
+	when      time.Time
+	logPrefix string
+}
+
+// pfPendingKills keeps pending kills of pf backends between Close and creation
+// of new backends on configuration reload.
+var pfPendingKills = map[string][]pendingKill{}
+
+// KillStates kills states or source tracking entries going to given address.
+// Redirected traffic keeps address of client as source, so any source is matched.
+func (l localPFctl) KillStates(mode string, ipAddress net.IP) error {
+	anyHost := "0.0.0.0/0"
+	if ipAddress.To4() == nil {
+		anyHost = "::/0"
+	}
+
+	flag := "-k"
+	if mode == lbpool.KillSources {
+		flag = "-K"
+	}
+
+	_, err := l.pfctlCmd([]string{flag, anyHost, flag, ipAddress.String()})
+	return err
+}
+
+// killStates handles states of nodes removed from table of LB Pool. States
+// to failed nodes are killed immediately, states to nodes removed for other
+// reasons are killed after grace period. Nodes added back to table before
+// grace period is over keep their states.
+func (b *PF) killStates(lbPool *lbpool.LBPool, table string, addSet []net.IP, delSet []net.IP) {
+	mode, grace := lbPool.GetKillStates()
+	logPrefix := lbPool.GetLogPrefix()
+
+	// Cancel pending kills of nodes which are back in table.
+	var pendingKills []pendingKill
+	for _, pk := range b.pendingKills {
+		found := false
+		for _, add := range addSet {
+			if pk.table == table && pk.ipAddress.Equal(add) {
+				found = true
+				logger.Info.Printf(pk.logPrefix+"table: %s address: %s kill_states: canceled", pk.table, pk.ipAddress)
+			}
+		}
+		if found == false {
+			pendingKills = append(pendingKills, pk)
+		}
+	}
+	b.pendingKills = pendingKills
+
+	if mode == lbpool.KillNone {
+		return
+	}
+
+	for _, del := range delSet {
+		if grace == 0 || lbPool.NodeFailed(del) {
+			logger.Info.Printf(logPrefix+"table: %s deleted: %s kill_states: %s", table, del, mode)
+			if err := b.pfctl.KillStates(mode, del); err != nil {
+				logger.Error.Printf("%s%v", logPrefix, err)
+			}
+		} else {
+			logger.Info.Printf(logPrefix+"table: %s deleted: %s kill_states: %s in %s", table, del, mode, grace)
+			b.pendingKills = append(b.pendingKills, pendingKill{
+				table:     table,
+				ipAddress: del,
+				mode:      mode,
+				when:      time.Now().Add(grace),
+				logPrefix: logPrefix,
+			})
+		}
+	}
+}
+
+// doPendingKills kills states of nodes whose grace period is over.
+func (b *PF) doPendingKills() {
+	now := time.Now()
+	var pendingKills []pendingKill
+	for _, pk := range b.pendingKills {
+		if now.Before(pk.when) {
+			pendingKills = append(pendingKills, pk)
+			continue
+		}
+		logger.Info.Printf(pk.logPrefix+"table: %s address: %s kill_states: %s", pk.table, pk.ipAddress, pk.mode)
+		if err := b.pfctl.KillStates(pk.mode, pk.ipAddress); err != nil {
+			logger.Error.Printf("%s%v", pk.logPrefix, err)
+		}
+	}
+	b.pendingKills = pendingKills
+}
@@ -0,0 +1,271 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Types of BGP messages.
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+)
+
+// Path attribute types and flags.
+const (
+	attrOrigin        = 1
+	attrASPath        = 2
+	attrNextHop       = 3
+	attrMED           = 4
+	attrLocalPref     = 5
+	attrCommunities   = 8
+	attrMPReachNLRI   = 14
+	attrMPUnreachNLRI = 15
+	attrAS4Path       = 17
+
+	flagOptional   = 0x80
+	flagTransitive = 0x40
+	flagExtended   = 0x10
+)
+
+// Capabilities announced in OPEN message.
+const (
+	capMultiprotocol = 1
+	capFourOctetAS   = 65
+)
+
+const (
+	afiIPv4     = 1
+	afiIPv6     = 2
+	safiUnicast = 1
+
+	// asTrans is used in 2-octet AS fields for ASNs which do not fit there.
+	asTrans = 23456
+
+	// communityGracefulShutdown is GRACEFUL_SHUTDOWN well-known community, RFC 8326.
+	communityGracefulShutdown = 0xFFFF0000
+
+	headerLen = 19
+)
+
+// message builds BGP message of given type.
+func message(msgType byte, body []byte) []byte {
+	msg := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:], uint16(headerLen+len(body)))
+	msg[18] = msgType
+	return append(msg, body...)
+}
+
+// openMessage builds OPEN message announcing IPv4 and IPv6 unicast
+// and 4-octet AS numbers.
+func openMessage(asn uint32, holdTime uint16, routerID net.IP) []byte {
+	var caps []byte
+	for _, afi := range []uint16{afiIPv4, afiIPv6} {
+		caps = append(caps, capMultiprotocol, 4, byte(afi>>8), byte(afi), 0, safiUnicast)
+	}
+	caps = append(caps, capFourOctetAS, 4)
+	caps = appendUint32(caps, asn)
+
+	myAS := uint16(asTrans)
+	if asn <= 0xffff {
+		myAS = uint16(asn)
+	}
+
+	body := []byte{4}
+	body = appendUint16(body, myAS)
+	body = appendUint16(body, holdTime)
+	body = append(body, routerID.To4()...)
+	// A single optional parameter of type 2 (capabilities) holding all of them.
+	body = append(body, byte(len(caps)+2), 2, byte(len(caps)))
+	body = append(body, caps...)
+	return message(msgOpen, body)
+}
+
+// peerOpen is content of OPEN message received from peer.
+type peerOpen struct {
+	asn        uint32
+	holdTime   uint16
+	fourByteAS bool
+}
+
+// parseOpen reads body of OPEN message received from peer.
+func parseOpen(body []byte) (*peerOpen, error) {
+	if len(body) < 10 || body[0] != 4 {
+		return nil, fmt.Errorf("bad OPEN message")
+	}
+	open := &peerOpen{
+		asn:      uint32(binary.BigEndian.Uint16(body[1:])),
+		holdTime: binary.BigEndian.Uint16(body[3:]),
+	}
+	params := body[10:]
+	if len(params) < int(body[9]) {
+		return nil, fmt.Errorf("bad OPEN message parameters")
+	}
+	params = params[:body[9]]
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return nil, fmt.Errorf("bad OPEN message parameters")
+		}
+		if paramType == 2 {
+			caps := params[2 : 2+paramLen]
+			for len(caps) >= 2 {
+				capCode, capLen := caps[0], int(caps[1])
+				if len(caps) < 2+capLen {
+					return nil, fmt.Errorf("bad OPEN message capabilities")
+				}
+				if capCode == capFourOctetAS && capLen == 4 {
+					open.fourByteAS = true
+					open.asn = binary.BigEndian.Uint32(caps[2:])
+				}
+				caps = caps[2+capLen:]
+			}
+		}
+		params = params[2+paramLen:]
+	}
+	return open, nil
+}
+
+// notificationMessage builds NOTIFICATION message.
+func notificationMessage(code byte, subcode byte) []byte {
+	return message(msgNotification, []byte{code, subcode})
+}
+
+// keepaliveMessage builds KEEPALIVE message.
+func keepaliveMessage() []byte {
+	return message(msgKeepalive, nil)
+}
+
+// attribute encodes a single path attribute.
+func attribute(flags byte, attrType byte, value []byte) []byte {
+	if len(value) > 255 {
+		attr := []byte{flags | flagExtended, attrType}
+		attr = appendUint16(attr, uint16(len(value)))
+		return append(attr, value...)
+	}
+	return append([]byte{flags, attrType, byte(len(value))}, value...)
+}
+
+// prefix encodes host route to given address.
+func prefix(ipAddress net.IP) []byte {
+	if ip4 := ipAddress.To4(); ip4 != nil {
+		return append([]byte{32}, ip4...)
+	}
+	return append([]byte{128}, ipAddress.To16()...)
+}
+
+// announceMessage builds UPDATE message announcing route.
+func announceMessage(rt route, session *session) []byte {
+	var attrs []byte
+
+	// Origin IGP.
+	attrs = append(attrs, attribute(flagTransitive, attrOrigin, []byte{0})...)
+
+	// AS path is empty towards iBGP peers. Peers without 4-octet AS support
+	// get AS_TRANS in AS path and the real ASN in AS4_PATH, RFC 6793.
+	var asPath, as4Path []byte
+	if session.ibgp == false {
+		asPath = []byte{2, 1}
+		if session.fourByteAS {
+			asPath = appendUint32(asPath, session.asn)
+		} else if session.asn <= 0xffff {
+			asPath = appendUint16(asPath, uint16(session.asn))
+		} else {
+			asPath = appendUint16(asPath, asTrans)
+			as4Path = appendUint32([]byte{2, 1}, session.asn)
+		}
+	}
+	attrs = append(attrs, attribute(flagTransitive, attrASPath, asPath)...)
+	if as4Path != nil {
+		attrs = append(attrs, attribute(flagOptional|flagTransitive, attrAS4Path, as4Path)...)
+	}
+
+	if rt.med != nil {
+		attrs = append(attrs, attribute(flagOptional, attrMED, appendUint32(nil, *rt.med))...)
+	}
+	if session.ibgp && rt.localPref != nil {
+		attrs = append(attrs, attribute(flagTransitive, attrLocalPref, appendUint32(nil, *rt.localPref))...)
+	}
+	if len(rt.communities) > 0 {
+		var communities []byte
+		for _, community := range rt.communities {
+			communities = appendUint32(communities, community)
+		}
+		attrs = append(attrs, attribute(flagOptional|flagTransitive, attrCommunities, communities)...)
+	}
+
+	var nlri []byte
+	if rt.ipAddress.To4() != nil {
+		attrs = append(attrs, attribute(flagTransitive, attrNextHop, session.nextHop4.To4())...)
+		nlri = prefix(rt.ipAddress)
+	} else {
+		mpReach := appendUint16(nil, afiIPv6)
+		mpReach = append(mpReach, safiUnicast, 16)
+		mpReach = append(mpReach, session.nextHop6.To16()...)
+		mpReach = append(mpReach, 0)
+		mpReach = append(mpReach, prefix(rt.ipAddress)...)
+		attrs = append(attrs, attribute(flagOptional, attrMPReachNLRI, mpReach)...)
+	}
+
+	body := appendUint16(nil, 0)
+	body = appendUint16(body, uint16(len(attrs)))
+	body = append(body, attrs...)
+	body = append(body, nlri...)
+	return message(msgUpdate, body)
+}
+
+// withdrawMessage builds UPDATE message withdrawing route to given address.
+func withdrawMessage(ipAddress net.IP) []byte {
+	var body []byte
+	if ipAddress.To4() != nil {
+		withdrawn := prefix(ipAddress)
+		body = appendUint16(body, uint16(len(withdrawn)))
+		body = append(body, withdrawn...)
+		body = appendUint16(body, 0)
+	} else {
+		mpUnreach := appendUint16(nil, afiIPv6)
+		mpUnreach = append(mpUnreach, safiUnicast)
+		mpUnreach = append(mpUnreach, prefix(ipAddress)...)
+		attrs := attribute(flagOptional, attrMPUnreachNLRI, mpUnreach)
+		body = appendUint16(body, 0)
+		body = appendUint16(body, uint16(len(attrs)))
+		body = append(body, attrs...)
+	}
+	return message(msgUpdate, body)
+}
+
+// parseCommunity parses community in "asn:value" format or a well-known name.
+func parseCommunity(community string) (uint32, error) {
+	if community == "graceful_shutdown" {
+		return communityGracefulShutdown, nil
+	}
+	parts := strings.Split(community, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("bad community %s", community)
+	}
+	high, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad community %s", community)
+	}
+	low, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad community %s", community)
+	}
+	return uint32(high)<<16 | uint32(low), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
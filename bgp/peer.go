@@ -0,0 +1,289 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/innogames/yacht/logger"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// peer is a configured BGP neighbor. Its session is reestablished whenever it fails.
+type peer struct {
+	// Configuration
+	speaker   *Speaker
+	config    map[string]interface{}
+	address   string
+	asn       uint32
+	nextHop4  net.IP
+	nextHop6  net.IP
+	logPrefix string
+
+	// Communication
+	changed  chan bool
+	stopChan chan bool
+	done     chan bool
+}
+
+// session is a single TCP connection to peer.
+type session struct {
+	*peer
+	conn       net.Conn
+	closed     chan bool
+	asn        uint32
+	ibgp       bool
+	fourByteAS bool
+	holdTime   time.Duration
+	lastSent   time.Time
+	lastRecv   time.Time
+	advertised map[string]route
+}
+
+// bgpMsg is a message received from peer.
+type bgpMsg struct {
+	msgType byte
+	body    []byte
+}
+
+// newPeer creates peer from JSON configuration.
+func newPeer(s *Speaker, json map[string]interface{}) *peer {
+	p := new(peer)
+	p.speaker = s
+	p.config = json
+	p.changed = make(chan bool, 1)
+	p.stopChan = make(chan bool)
+	p.done = make(chan bool)
+
+	address, _ := json["address"].(string)
+	if net.ParseIP(address) == nil {
+		logger.Error.Printf("bgp: peer: %s invalid address", address)
+		return nil
+	}
+	port := 179
+	if portConfig, ok := json["port"].(float64); ok && portConfig > 0 {
+		port = int(portConfig)
+	}
+	p.address = net.JoinHostPort(address, strconv.Itoa(port))
+	p.logPrefix = "bgp: peer: " + p.address + " "
+
+	asn, ok := json["asn"].(float64)
+	if !ok || asn <= 0 {
+		logger.Error.Printf("%sasn must be configured", p.logPrefix)
+		return nil
+	}
+	p.asn = uint32(asn)
+
+	if nextHop, ok := json["next_hop4"].(string); ok {
+		p.nextHop4 = net.ParseIP(nextHop).To4()
+	}
+	if nextHop, ok := json["next_hop6"].(string); ok {
+		p.nextHop6 = net.ParseIP(nextHop)
+	}
+
+	return p
+}
+
+// run keeps session to peer up until peer is stopped.
+func (p *peer) run() {
+	defer close(p.done)
+	for {
+		err := p.session()
+		select {
+		case <-p.stopChan:
+			return
+		default:
+		}
+		logger.Warning.Printf(p.logPrefix+"session down: %v", err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-p.stopChan:
+			return
+		}
+	}
+}
+
+// stop closes session to peer and waits for it to finish.
+func (p *peer) stop() {
+	close(p.stopChan)
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// session connects to peer and handles BGP messages until an error occurs or
+// peer is stopped.
+func (p *peer) session() error {
+	conn, err := net.DialTimeout("tcp", p.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	asn, holdTimeConfig, routerID := p.speaker.getOpenParams()
+	s := &session{
+		peer:       p,
+		conn:       conn,
+		closed:     make(chan bool),
+		asn:        asn,
+		ibgp:       p.asn == asn,
+		holdTime:   4 * time.Minute,
+		lastRecv:   time.Now(),
+		advertised: map[string]route{},
+	}
+	if p.nextHop4 == nil {
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			p.nextHop4 = local.IP.To4()
+		}
+	}
+
+	if err := s.send(openMessage(asn, holdTimeConfig, routerID)); err != nil {
+		return err
+	}
+
+	defer close(s.closed)
+
+	msgs := make(chan bgpMsg)
+	errs := make(chan error, 1)
+	go s.read(msgs, errs)
+
+	established := false
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-msgs:
+			s.lastRecv = time.Now()
+			switch msg.msgType {
+			case msgOpen:
+				open, err := parseOpen(msg.body)
+				if err != nil {
+					s.send(notificationMessage(2, 0))
+					return err
+				}
+				if open.asn != p.asn {
+					s.send(notificationMessage(2, 2))
+					return fmt.Errorf("peer has asn %d", open.asn)
+				}
+				s.fourByteAS = open.fourByteAS
+				holdTime := holdTimeConfig
+				if open.holdTime < holdTime {
+					holdTime = open.holdTime
+				}
+				s.holdTime = time.Duration(holdTime) * time.Second
+				if err := s.send(keepaliveMessage()); err != nil {
+					return err
+				}
+			case msgKeepalive:
+				if established == false {
+					established = true
+					logger.Info.Printf("%ssession established", p.logPrefix)
+					if err := s.sync(); err != nil {
+						return err
+					}
+				}
+			case msgNotification:
+				if len(msg.body) >= 2 {
+					return fmt.Errorf("received notification %d/%d", msg.body[0], msg.body[1])
+				}
+				return fmt.Errorf("received notification")
+			}
+		case err := <-errs:
+			return err
+		case <-p.changed:
+			if established {
+				if err := s.sync(); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if s.holdTime > 0 && time.Since(s.lastRecv) > s.holdTime {
+				s.send(notificationMessage(4, 0))
+				return fmt.Errorf("hold timer expired")
+			}
+			if established && s.holdTime > 0 && time.Since(s.lastSent) >= s.holdTime/3 {
+				if err := s.send(keepaliveMessage()); err != nil {
+					return err
+				}
+			}
+		case <-p.stopChan:
+			// Cease, administrative shutdown.
+			s.send(notificationMessage(6, 2))
+			return nil
+		}
+	}
+}
+
+// read receives messages from peer and passes them to session.
+func (s *session) read(msgs chan bgpMsg, errs chan error) {
+	header := make([]byte, headerLen)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			errs <- err
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[16:]))
+		if length < headerLen || length > 4096 {
+			errs <- fmt.Errorf("bad message length %d", length)
+			return
+		}
+		body := make([]byte, length-headerLen)
+		if _, err := io.ReadFull(s.conn, body); err != nil {
+			errs <- err
+			return
+		}
+		select {
+		case msgs <- bgpMsg{header[18], body}:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// send writes message to peer.
+func (s *session) send(msg []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := s.conn.Write(msg)
+	s.lastSent = time.Now()
+	return err
+}
+
+// sync sends to peer all differences between routes which should be
+// announced and routes which were announced to it.
+func (s *session) sync() error {
+	routes := s.speaker.getRoutes()
+
+	for key, rt := range s.advertised {
+		if _, ok := routes[key]; !ok {
+			logger.Debug.Printf(s.logPrefix+"withdraw: %s", key)
+			if err := s.send(withdrawMessage(rt.ipAddress)); err != nil {
+				return err
+			}
+			delete(s.advertised, key)
+		}
+	}
+
+	for key, rt := range routes {
+		if cur, ok := s.advertised[key]; ok && cur.equal(rt) {
+			continue
+		}
+		if rt.ipAddress.To4() == nil && s.nextHop6 == nil {
+			logger.Error.Printf(s.logPrefix+"unable to announce %s, next_hop6 not configured", key)
+			continue
+		}
+		if rt.ipAddress.To4() != nil && s.nextHop4 == nil {
+			logger.Error.Printf(s.logPrefix+"unable to announce %s, next_hop4 not configured", key)
+			continue
+		}
+		logger.Debug.Printf(s.logPrefix+"announce: %s", key)
+		if err := s.send(announceMessage(rt, s)); err != nil {
+			return err
+		}
+		s.advertised[key] = rt
+	}
+
+	return nil
+}
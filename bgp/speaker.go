@@ -0,0 +1,323 @@
+package bgp
+
+import (
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Speaker announces IP addresses of LB Pools as host routes to BGP peers
+// while LB Pools are serviceable, and withdraws them otherwise. It lives
+// across configuration reloads, so that BGP sessions are not reset.
+type Speaker struct {
+	sync.Mutex
+
+	// Configuration
+	asn           uint32
+	routerID      net.IP
+	holdTime      uint16
+	shutdownDelay time.Duration
+	peers         []*peer
+
+	// Operation
+	routes     map[string]route
+	graceful   bool
+	followStop chan bool
+}
+
+// route is a host route to IP address of LB Pool with its attributes.
+type route struct {
+	ipAddress   net.IP
+	med         *uint32
+	localPref   *uint32
+	communities []uint32
+}
+
+// equal compares route with another one including attributes.
+func (rt route) equal(other route) bool {
+	if rt.ipAddress.Equal(other.ipAddress) == false || len(rt.communities) != len(other.communities) {
+		return false
+	}
+	if (rt.med == nil) != (other.med == nil) || (rt.med != nil && *rt.med != *other.med) {
+		return false
+	}
+	if (rt.localPref == nil) != (other.localPref == nil) || (rt.localPref != nil && *rt.localPref != *other.localPref) {
+		return false
+	}
+	for i := range rt.communities {
+		if rt.communities[i] != other.communities[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NewSpeaker creates BGP speaker from JSON configuration and starts sessions
+// to all of its peers. Returns nil if BGP is not configured.
+func NewSpeaker(json map[string]interface{}) *Speaker {
+	s := parseSpeaker(json)
+	if s == nil {
+		return nil
+	}
+	s.routes = map[string]route{}
+
+	logger.Info.Printf("bgp: asn: %d router_id: %s peers: %d created", s.asn, s.routerID, len(s.peers))
+
+	for _, p := range s.peers {
+		go p.run()
+	}
+	return s
+}
+
+// parseSpeaker reads configuration of BGP speaker and its peers from JSON.
+// Sessions are not started. Returns nil if configuration is missing or invalid.
+func parseSpeaker(json map[string]interface{}) *Speaker {
+	if json == nil {
+		return nil
+	}
+
+	s := new(Speaker)
+	s.holdTime = 90
+	s.shutdownDelay = 5 * time.Second
+
+	asn, ok := json["asn"].(float64)
+	if !ok || asn <= 0 {
+		logger.Error.Printf("bgp: asn must be configured")
+		return nil
+	}
+	s.asn = uint32(asn)
+
+	routerID, _ := json["router_id"].(string)
+	if s.routerID = net.ParseIP(routerID).To4(); s.routerID == nil {
+		logger.Error.Printf("bgp: router_id must be an IPv4 address")
+		return nil
+	}
+	if holdTime, ok := json["hold_time"].(float64); ok && (holdTime == 0 || holdTime >= 3) {
+		s.holdTime = uint16(holdTime)
+	}
+	if shutdownDelay, ok := json["shutdown_delay"].(float64); ok && shutdownDelay >= 0 {
+		s.shutdownDelay = time.Duration(shutdownDelay) * time.Second
+	}
+
+	peers, _ := json["peers"].([]interface{})
+	for _, peerConfig := range peers {
+		peerConfigMap, _ := peerConfig.(map[string]interface{})
+		if p := newPeer(s, peerConfigMap); p != nil {
+			s.peers = append(s.peers, p)
+		}
+	}
+	return s
+}
+
+// Reconfigure applies configuration changed on reload. Sessions of peers whose
+// configuration is the same are kept, other peers are stopped and started
+// again. Change of asn or router_id restarts all sessions. Invalid
+// configuration is ignored and the running one is kept.
+func (s *Speaker) Reconfigure(json map[string]interface{}) {
+	n := parseSpeaker(json)
+	if n == nil {
+		logger.Error.Printf("bgp: invalid configuration, keeping the running one")
+		return
+	}
+
+	s.Lock()
+	restartAll := s.asn != n.asn || s.routerID.Equal(n.routerID) == false
+	oldPeers := s.peers
+	s.Unlock()
+
+	var keep, stop []*peer
+	for _, old := range oldPeers {
+		kept := false
+		for i, p := range n.peers {
+			if restartAll == false && p != nil && reflect.DeepEqual(old.config, p.config) {
+				keep = append(keep, old)
+				n.peers[i] = nil
+				kept = true
+				break
+			}
+		}
+		if kept == false {
+			stop = append(stop, old)
+		}
+	}
+	for _, p := range stop {
+		logger.Info.Printf("%sstopped", p.logPrefix)
+		p.stop()
+	}
+
+	var start []*peer
+	for _, p := range n.peers {
+		if p != nil {
+			p.speaker = s
+			start = append(start, p)
+		}
+	}
+
+	s.Lock()
+	s.asn = n.asn
+	s.routerID = n.routerID
+	s.holdTime = n.holdTime
+	s.shutdownDelay = n.shutdownDelay
+	s.peers = append(keep, start...)
+	s.Unlock()
+
+	logger.Info.Printf("bgp: asn: %d router_id: %s peers: %d kept: %d reconfigured", n.asn, n.routerID, len(keep)+len(start), len(keep))
+	for _, p := range start {
+		go p.run()
+	}
+}
+
+// getPeers returns copy of list of peers.
+func (s *Speaker) getPeers() []*peer {
+	defer s.Unlock()
+	s.Lock()
+	return append([]*peer{}, s.peers...)
+}
+
+// getOpenParams returns parameters announced in OPEN message of new session.
+func (s *Speaker) getOpenParams() (uint32, uint16, net.IP) {
+	defer s.Unlock()
+	s.Lock()
+	return s.asn, s.holdTime, s.routerID
+}
+
+// Follow subscribes to changes of LB Pools and keeps their routes announced
+// according to their state. Routes of LB Pools not present anymore are withdrawn.
+// It must be called before LB Pools are run.
+func (s *Speaker) Follow(lbPools []*lbpool.LBPool) {
+	s.Lock()
+	if s.followStop != nil {
+		close(s.followStop)
+	}
+	s.followStop = make(chan bool)
+
+	present := map[string]bool{}
+	for _, lbPool := range lbPools {
+		if ipAddress := lbPool.GetIPAddress(); ipAddress != nil {
+			present[ipAddress.String()] = true
+		}
+	}
+	for key := range s.routes {
+		if present[key] == false {
+			delete(s.routes, key)
+		}
+	}
+	stop := s.followStop
+	s.Unlock()
+	s.notifyPeers()
+
+	for _, lbPool := range lbPools {
+		if lbPool.GetIPAddress() == nil {
+			continue
+		}
+		go s.follow(lbPool, lbPool.Subscribe(), stop)
+	}
+}
+
+// follow updates route of LB Pool whenever LB Pool changes. Until LB Pool has
+// decided about its nodes, previous state of route is kept.
+func (s *Speaker) follow(lbPool *lbpool.LBPool, changes chan bool, stop chan bool) {
+	for {
+		if serviceable, known := lbPool.GetServiceable(); known {
+			s.setRoute(lbPool, serviceable)
+		}
+		select {
+		case <-changes:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// setRoute announces or withdraws route of LB Pool.
+func (s *Speaker) setRoute(lbPool *lbpool.LBPool, serviceable bool) {
+	rt := route{ipAddress: lbPool.GetIPAddress()}
+	key := rt.ipAddress.String()
+
+	options := lbPool.GetBGPOptions()
+	if med, ok := options["med"].(float64); ok {
+		v := uint32(med)
+		rt.med = &v
+	}
+	if localPref, ok := options["local_pref"].(float64); ok {
+		v := uint32(localPref)
+		rt.localPref = &v
+	}
+	communities, _ := options["communities"].([]interface{})
+	for _, community := range communities {
+		communityStr, _ := community.(string)
+		c, err := parseCommunity(communityStr)
+		if err != nil {
+			logger.Error.Printf(lbPool.GetLogPrefix()+"bgp: %v", err)
+			continue
+		}
+		rt.communities = append(rt.communities, c)
+	}
+
+	s.Lock()
+	cur, announced := s.routes[key]
+	changed := false
+	if serviceable && (announced == false || cur.equal(rt) == false) {
+		logger.Info.Printf(lbPool.GetLogPrefix()+"bgp: %s action: announce", key)
+		s.routes[key] = rt
+		changed = true
+	} else if serviceable == false && announced {
+		logger.Info.Printf(lbPool.GetLogPrefix()+"bgp: %s action: withdraw", key)
+		delete(s.routes, key)
+		changed = true
+	}
+	s.Unlock()
+
+	if changed {
+		s.notifyPeers()
+	}
+}
+
+// getRoutes returns copy of routes which should be announced. During graceful
+// shutdown all of them carry GRACEFUL_SHUTDOWN community.
+func (s *Speaker) getRoutes() map[string]route {
+	defer s.Unlock()
+	s.Lock()
+	ret := map[string]route{}
+	for key, rt := range s.routes {
+		if s.graceful {
+			rt.communities = append(append([]uint32{}, rt.communities...), communityGracefulShutdown)
+		}
+		ret[key] = rt
+	}
+	return ret
+}
+
+// notifyPeers tells all sessions to send changes of routes.
+func (s *Speaker) notifyPeers() {
+	for _, p := range s.getPeers() {
+		select {
+		case p.changed <- true:
+		default:
+		}
+	}
+}
+
+// Shutdown terminates all BGP sessions. Graceful shutdown first announces
+// all routes with GRACEFUL_SHUTDOWN community and waits for peers to move
+// traffic away before sessions are closed.
+func (s *Speaker) Shutdown(graceful bool) {
+	s.Lock()
+	shutdownDelay := s.shutdownDelay
+	s.Unlock()
+	if graceful && shutdownDelay > 0 {
+		logger.Info.Printf("bgp: graceful shutdown, waiting %s", shutdownDelay)
+		s.Lock()
+		s.graceful = true
+		s.Unlock()
+		s.notifyPeers()
+		time.Sleep(shutdownDelay)
+	}
+
+	for _, p := range s.getPeers() {
+		p.stop()
+	}
+}
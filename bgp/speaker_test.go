@@ -0,0 +1,233 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakePeer is the remote side of BGP session accepting connection from Speaker.
+type fakePeer struct {
+	t        *testing.T
+	listener net.Listener
+	conn     net.Conn
+}
+
+func newFakePeer(t *testing.T) *fakePeer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return &fakePeer{t: t, listener: listener}
+}
+
+func (f *fakePeer) port() float64 {
+	return float64(f.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// accept waits for session from Speaker and exchanges OPEN messages.
+func (f *fakePeer) accept(open []byte) *peerOpen {
+	f.listener.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := f.listener.Accept()
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() { conn.Close() })
+	f.conn = conn
+
+	msgType, body := f.read()
+	if msgType != msgOpen {
+		f.t.Fatalf("got message type %d, want OPEN", msgType)
+	}
+	speakerOpen, err := parseOpen(body)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.write(open)
+	if msgType, _ := f.read(); msgType != msgKeepalive {
+		f.t.Fatalf("got message type %d, want KEEPALIVE", msgType)
+	}
+	f.write(keepaliveMessage())
+	return speakerOpen
+}
+
+func (f *fakePeer) read() (byte, []byte) {
+	f.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(f.conn, header); err != nil {
+		f.t.Fatal(err)
+	}
+	body := make([]byte, int(binary.BigEndian.Uint16(header[16:]))-headerLen)
+	if _, err := io.ReadFull(f.conn, body); err != nil {
+		f.t.Fatal(err)
+	}
+	return header[18], body
+}
+
+// readUpdate skips keepalives and returns withdrawn routes, path attributes
+// and NLRI of the next UPDATE message.
+func (f *fakePeer) readUpdate() ([]byte, map[byte][]byte, []byte) {
+	for {
+		msgType, body := f.read()
+		if msgType == msgKeepalive {
+			continue
+		}
+		if msgType != msgUpdate {
+			f.t.Fatalf("got message type %d, want UPDATE", msgType)
+		}
+		withdrawnLen := int(binary.BigEndian.Uint16(body))
+		withdrawn := body[2 : 2+withdrawnLen]
+		body = body[2+withdrawnLen:]
+		attrsLen := int(binary.BigEndian.Uint16(body))
+		attrs := body[2 : 2+attrsLen]
+		nlri := body[2+attrsLen:]
+
+		parsed := map[byte][]byte{}
+		for len(attrs) > 0 {
+			flags, attrType := attrs[0], attrs[1]
+			var value []byte
+			if flags&flagExtended != 0 {
+				length := int(binary.BigEndian.Uint16(attrs[2:]))
+				value, attrs = attrs[4:4+length], attrs[4+length:]
+			} else {
+				length := int(attrs[2])
+				value, attrs = attrs[3:3+length], attrs[3+length:]
+			}
+			parsed[attrType] = value
+		}
+		return withdrawn, parsed, nlri
+	}
+}
+
+func (f *fakePeer) write(msg []byte) {
+	if _, err := f.conn.Write(msg); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// openWithoutCapabilities builds OPEN message of peer without support of
+// 4-octet AS numbers.
+func openWithoutCapabilities(asn uint16, routerID net.IP) []byte {
+	body := []byte{4}
+	body = appendUint16(body, asn)
+	body = appendUint16(body, 90)
+	body = append(body, routerID.To4()...)
+	body = append(body, 0)
+	return message(msgOpen, body)
+}
+
+func newTestLBPool() *lbpool.LBPool {
+	return lbpool.NewLBPool("4", "web", map[string]interface{}{
+		"ip4":          "192.0.2.1",
+		"pf_name":      "web",
+		"healthchecks": []interface{}{},
+		"nodes":        map[string]interface{}{},
+		"bgp":          map[string]interface{}{"med": 10.0},
+	})
+}
+
+func TestSpeakerAnnounceWithdraw(t *testing.T) {
+	logger.InitLoggers(false)
+
+	fake := newFakePeer(t)
+	config := map[string]interface{}{
+		"asn":       65000.0,
+		"router_id": "192.0.2.254",
+		"peers": []interface{}{
+			map[string]interface{}{
+				"address":   "127.0.0.1",
+				"port":      fake.port(),
+				"asn":       65001.0,
+				"next_hop4": "192.0.2.253",
+			},
+		},
+	}
+	s := NewSpeaker(config)
+	defer s.Shutdown(false)
+
+	speakerOpen := fake.accept(openMessage(65001, 90, net.ParseIP("192.0.2.100")))
+	if speakerOpen.asn != 65000 || speakerOpen.fourByteAS == false {
+		t.Fatalf("got OPEN with asn %d four byte AS %v", speakerOpen.asn, speakerOpen.fourByteAS)
+	}
+
+	lbPool := newTestLBPool()
+	s.setRoute(lbPool, true)
+	_, attrs, nlri := fake.readUpdate()
+	if net.IP(nlri[1:]).Equal(net.ParseIP("192.0.2.1")) == false || nlri[0] != 32 {
+		t.Errorf("announced NLRI %v", nlri)
+	}
+	if net.IP(attrs[attrNextHop]).Equal(net.ParseIP("192.0.2.253")) == false {
+		t.Errorf("announced next hop %v", attrs[attrNextHop])
+	}
+	if binary.BigEndian.Uint32(attrs[attrMED]) != 10 {
+		t.Errorf("announced MED %v", attrs[attrMED])
+	}
+	if asPath := attrs[attrASPath]; len(asPath) != 6 || binary.BigEndian.Uint32(asPath[2:]) != 65000 {
+		t.Errorf("announced AS path %v", asPath)
+	}
+
+	// Unchanged configuration must keep the session.
+	s.Reconfigure(config)
+
+	s.setRoute(lbPool, false)
+	withdrawn, _, _ := fake.readUpdate()
+	if len(withdrawn) != 5 || net.IP(withdrawn[1:]).Equal(net.ParseIP("192.0.2.1")) == false {
+		t.Errorf("withdrawn routes %v", withdrawn)
+	}
+}
+
+func TestSpeakerAS4Path(t *testing.T) {
+	logger.InitLoggers(false)
+
+	fake := newFakePeer(t)
+	s := NewSpeaker(map[string]interface{}{
+		"asn":       4200000000.0,
+		"router_id": "192.0.2.254",
+		"peers": []interface{}{
+			map[string]interface{}{
+				"address":   "127.0.0.1",
+				"port":      fake.port(),
+				"asn":       65001.0,
+				"next_hop4": "192.0.2.253",
+			},
+		},
+	})
+	defer s.Shutdown(false)
+
+	speakerOpen := fake.accept(openWithoutCapabilities(65001, net.ParseIP("192.0.2.100")))
+	if speakerOpen.asn != 4200000000 {
+		t.Fatalf("got OPEN with asn %d", speakerOpen.asn)
+	}
+
+	s.setRoute(newTestLBPool(), true)
+	_, attrs, _ := fake.readUpdate()
+	if asPath := attrs[attrASPath]; len(asPath) != 4 || binary.BigEndian.Uint16(asPath[2:]) != asTrans {
+		t.Errorf("announced AS path %v", asPath)
+	}
+	as4Path, ok := attrs[attrAS4Path]
+	if !ok || len(as4Path) != 6 || binary.BigEndian.Uint32(as4Path[2:]) != 4200000000 {
+		t.Errorf("announced AS4 path %v", as4Path)
+	}
+}
+
+func TestParseCommunity(t *testing.T) {
+	for community, want := range map[string]uint32{
+		"65000:100":         65000<<16 | 100,
+		"graceful_shutdown": communityGracefulShutdown,
+	} {
+		got, err := parseCommunity(community)
+		if err != nil || got != want {
+			t.Errorf("parseCommunity(%s) = %d, %v want %d", community, got, err, want)
+		}
+	}
+	for _, community := range []string{"65000", "70000:1", "a:b", "1:2:3"} {
+		if _, err := parseCommunity(community); err == nil {
+			t.Errorf("parseCommunity(%s) accepted", community)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package dnsserver
+
+import (
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Server is an authoritative DNS server answering queries for names of LB Pools
+// with addresses of their wanted nodes. A records come from IPv4 LB Pool and
+// AAAA records from IPv6 one.
+type Server struct {
+	sync.RWMutex
+
+	// Configuration
+	zone    string
+	ttl     uint32
+	listen  string
+	records map[string]*record
+
+	// Operation
+	servers  []*dns.Server
+	stopChan chan bool
+	counter  uint32
+}
+
+// record is a single name served by Server.
+type record struct {
+	poolName  string
+	ttl       uint32
+	fallback  []net.IP
+	addresses map[string][]net.IP
+}
+
+// NewServer creates and starts DNS server from JSON configuration. It subscribes
+// to changes of all LB Pools it serves, so it must be created before they are run.
+// Returns nil if DNS server is not configured.
+func NewServer(json map[string]interface{}, lbPools []*lbpool.LBPool) *Server {
+	if json == nil {
+		return nil
+	}
+
+	srv := new(Server)
+	srv.stopChan = make(chan bool)
+	srv.records = map[string]*record{}
+	srv.listen = "127.0.0.1:53"
+	srv.ttl = 30
+
+	zone, ok := json["zone"].(string)
+	if !ok {
+		logger.Error.Printf("dns: zone must be configured")
+		return nil
+	}
+	srv.zone = dns.CanonicalName(zone)
+	if listen, ok := json["listen"].(string); ok {
+		srv.listen = listen
+	}
+	if ttl, ok := json["ttl"].(float64); ok && ttl >= 0 {
+		srv.ttl = uint32(ttl)
+	}
+
+	// Records are either configured explicitly or there is one for each LB Pool.
+	if records, ok := json["records"].(map[string]interface{}); ok {
+		for name, recordConfig := range records {
+			recordConfigMap, _ := recordConfig.(map[string]interface{})
+			srv.addRecord(name, recordConfigMap)
+		}
+	} else {
+		for _, lbPool := range lbPools {
+			srv.addRecord(lbPool.GetBaseName(), map[string]interface{}{})
+		}
+	}
+
+	// Subscribe to all LB Pools used by records.
+	for _, lbPool := range lbPools {
+		for _, rec := range srv.records {
+			if rec.poolName == lbPool.GetBaseName() {
+				go srv.follow(lbPool, rec, lbPool.Subscribe())
+			}
+		}
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{
+			Addr:    srv.listen,
+			Net:     network,
+			Handler: dns.HandlerFunc(srv.serveDNS),
+		}
+		srv.servers = append(srv.servers, server)
+		go func(server *dns.Server) {
+			if err := server.ListenAndServe(); err != nil {
+				logger.Error.Printf("dns: %s %v", server.Net, err)
+			}
+		}(server)
+	}
+
+	logger.Info.Printf("dns: zone: %s listen: %s records: %d created", srv.zone, srv.listen, len(srv.records))
+	return srv
+}
+
+// addRecord adds a record from its JSON configuration. Name is relative to zone.
+func (srv *Server) addRecord(name string, json map[string]interface{}) {
+	rec := new(record)
+	rec.poolName = name
+	rec.ttl = srv.ttl
+	rec.addresses = map[string][]net.IP{}
+
+	if poolName, ok := json["lb_pool"].(string); ok {
+		rec.poolName = poolName
+	}
+	if ttl, ok := json["ttl"].(float64); ok && ttl >= 0 {
+		rec.ttl = uint32(ttl)
+	}
+	if fallback, ok := json["fallback"].([]interface{}); ok {
+		for _, address := range fallback {
+			addressStr, _ := address.(string)
+			if ipAddress := net.ParseIP(addressStr); ipAddress != nil {
+				rec.fallback = append(rec.fallback, ipAddress)
+			} else {
+				logger.Error.Printf("dns: record: %s invalid fallback %v", name, address)
+			}
+		}
+	}
+
+	srv.records[dns.CanonicalName(name+"."+srv.zone)] = rec
+}
+
+// follow updates addresses of record whenever wanted nodes of LB Pool change.
+func (srv *Server) follow(lbPool *lbpool.LBPool, rec *record, changes chan bool) {
+	for {
+		addresses := lbPool.GetWantedAddresses()
+		srv.Lock()
+		rec.addresses[lbPool.GetProto()] = addresses
+		srv.Unlock()
+		logger.Debug.Printf(lbPool.GetLogPrefix()+"dns: %s", addresses)
+
+		select {
+		case <-changes:
+		case <-srv.stopChan:
+			return
+		}
+	}
+}
+
+// answers returns addresses of record for given protocol. If LB Pool has no
+// wanted nodes, configured fallback addresses are used. Answers are rotated
+// on every query.
+func (srv *Server) answers(rec *record, proto string) []net.IP {
+	var ret []net.IP
+	ret = append(ret, rec.addresses[proto]...)
+	if len(ret) == 0 {
+		for _, ipAddress := range rec.fallback {
+			if (ipAddress.To4() != nil) == (proto == "4") {
+				ret = append(ret, ipAddress)
+			}
+		}
+	}
+	if len(ret) > 1 {
+		shift := int(atomic.AddUint32(&srv.counter, 1) % uint32(len(ret)))
+		ret = append(ret[shift:], ret[:shift]...)
+	}
+	return ret
+}
+
+// soa returns SOA record of zone, used in negative answers.
+func (srv *Server) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: srv.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: srv.ttl},
+		Ns:      "ns." + srv.zone,
+		Mbox:    "hostmaster." + srv.zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  srv.ttl,
+	}
+}
+
+// serveDNS answers a single DNS query.
+func (srv *Server) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	if len(req.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+		w.WriteMsg(resp)
+		return
+	}
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+
+	if dns.IsSubDomain(srv.zone, name) == false {
+		resp.Authoritative = false
+		resp.Rcode = dns.RcodeRefused
+		w.WriteMsg(resp)
+		return
+	}
+
+	srv.RLock()
+	rec, ok := srv.records[name]
+	var answers4, answers6 []net.IP
+	if ok {
+		answers4 = srv.answers(rec, "4")
+		answers6 = srv.answers(rec, "6")
+	}
+	srv.RUnlock()
+
+	if !ok {
+		if strings.EqualFold(name, srv.zone) == false {
+			resp.Rcode = dns.RcodeNameError
+		}
+		resp.Ns = append(resp.Ns, srv.soa())
+		w.WriteMsg(resp)
+		return
+	}
+
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+		for _, ipAddress := range answers4 {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: rec.ttl},
+				A:   ipAddress,
+			})
+		}
+	}
+	if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+		for _, ipAddress := range answers6 {
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: rec.ttl},
+				AAAA: ipAddress,
+			})
+		}
+	}
+	if len(resp.Answer) == 0 {
+		resp.Ns = append(resp.Ns, srv.soa())
+	}
+
+	w.WriteMsg(resp)
+}
+
+// Stop terminates DNS server and its subscriptions to LB Pools.
+func (srv *Server) Stop() {
+	close(srv.stopChan)
+	for _, server := range srv.servers {
+		server.Shutdown()
+	}
+}
@@ -0,0 +1,389 @@
+package gossip
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/innogames/yacht/logger"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxClockSkew is how much time of message can differ from local time.
+	maxClockSkew = 30 * time.Second
+	// maxPacketSize is the largest UDP packet which can be sent.
+	maxPacketSize = 65507
+)
+
+// Gossip exchanges health of LB Nodes with other yacht instances over
+// authenticated UDP messages. LB Node is down only if a quorum of observers
+// agrees. If not enough observers are reachable, local result is used.
+// It lives across configuration reloads. In dry run results of peers are
+// received, but own results are not sent, so that they do not count.
+type Gossip struct {
+	sync.Mutex
+
+	// Configuration
+	listen   string
+	name     string
+	key      []byte
+	quorum   int
+	interval time.Duration
+	timeout  time.Duration
+	peers    []*net.UDPAddr
+	dryRun   bool
+
+	// Operation
+	conn        *net.UDPConn
+	local       map[string]bool
+	remote      map[string]*peerState
+	decisions   map[string]bool
+	subscribers map[string]chan bool
+	stopChan    chan bool
+	stopped     sync.WaitGroup
+	logPrefix   string
+}
+
+// peerState holds the last results received from another instance.
+type peerState struct {
+	seen    time.Time
+	time    int64
+	results map[string]bool
+}
+
+// message is sent to all peers every interval.
+type message struct {
+	Name    string          `json:"name"`
+	Time    int64           `json:"time"`
+	Results map[string]bool `json:"results"`
+}
+
+// NewGossip creates Gossip from JSON configuration and starts exchanging
+// results with peers. Returns nil if gossip is not configured.
+func NewGossip(json map[string]interface{}, dryRun bool) *Gossip {
+	g := parseGossip(json)
+	if g == nil {
+		return nil
+	}
+	g.dryRun = dryRun
+	g.local = map[string]bool{}
+	g.remote = map[string]*peerState{}
+	g.decisions = map[string]bool{}
+	g.subscribers = map[string]chan bool{}
+	g.stopChan = make(chan bool)
+
+	addr, err := net.ResolveUDPAddr("udp", g.listen)
+	if err != nil {
+		logger.Error.Printf(g.logPrefix+"%v", err)
+		return nil
+	}
+	if g.conn, err = net.ListenUDP("udp", addr); err != nil {
+		logger.Error.Printf(g.logPrefix+"%v", err)
+		return nil
+	}
+
+	logger.Info.Printf(g.logPrefix+"listen: %s peers: %d quorum: %d dry run: %t created", g.listen, len(g.peers), g.quorum, g.dryRun)
+
+	g.stopped.Add(2)
+	go g.receive()
+	go g.run()
+
+	return g
+}
+
+// parseGossip creates Gossip with configuration only, nothing is started.
+// Returns nil if configuration is missing or invalid.
+func parseGossip(json map[string]interface{}) *Gossip {
+	if json == nil {
+		return nil
+	}
+
+	g := new(Gossip)
+	g.quorum = 2
+	g.interval = time.Second
+	g.timeout = 5 * time.Second
+
+	g.listen, _ = json["listen"].(string)
+	key, _ := json["key"].(string)
+	if g.listen == "" || key == "" {
+		logger.Error.Printf("gossip: listen and key must be configured")
+		return nil
+	}
+	g.key = []byte(key)
+
+	hostname, _ := os.Hostname()
+	g.name = hostname + "/" + g.listen
+	if name, ok := json["name"].(string); ok && name != "" {
+		g.name = name
+	}
+	g.logPrefix = "gossip: " + g.name + " "
+
+	if quorum, ok := json["quorum"].(float64); ok && quorum >= 1 {
+		g.quorum = int(quorum)
+	}
+	if interval, ok := json["interval"].(float64); ok && interval > 0 {
+		g.interval = time.Duration(interval * float64(time.Second))
+	}
+	if timeout, ok := json["timeout"].(float64); ok && timeout > 0 {
+		g.timeout = time.Duration(timeout * float64(time.Second))
+	}
+
+	peers, _ := json["peers"].([]interface{})
+	for _, peer := range peers {
+		peerStr, _ := peer.(string)
+		addr, err := net.ResolveUDPAddr("udp", peerStr)
+		if err != nil {
+			logger.Error.Printf(g.logPrefix+"peer: %s %v", peerStr, err)
+			continue
+		}
+		g.peers = append(g.peers, addr)
+	}
+
+	return g
+}
+
+// Reconfigure applies new configuration on reload while results of peers
+// are kept. Returns false if gossip must be stopped and created again
+// because it is not configured anymore or its listen address or name changed.
+func (g *Gossip) Reconfigure(json map[string]interface{}) bool {
+	if json == nil {
+		return false
+	}
+	n := parseGossip(json)
+	if n == nil {
+		logger.Error.Printf("%sinvalid configuration, keeping the running one", g.logPrefix)
+		return true
+	}
+
+	defer g.Unlock()
+	g.Lock()
+	if n.listen != g.listen || n.name != g.name {
+		return false
+	}
+	g.key = n.key
+	g.quorum = n.quorum
+	g.interval = n.interval
+	g.timeout = n.timeout
+	g.peers = n.peers
+	logger.Info.Printf(g.logPrefix+"peers: %d quorum: %d reconfigured", len(g.peers), g.quorum)
+	g.reevaluate()
+	return true
+}
+
+// Reset forgets local results and subscribers. It is called on configuration
+// reload before LB Nodes subscribe again.
+func (g *Gossip) Reset() {
+	defer g.Unlock()
+	g.Lock()
+	g.local = map[string]bool{}
+	g.decisions = map[string]bool{}
+	g.subscribers = map[string]chan bool{}
+}
+
+// Subscribe returns a channel which receives a message whenever decision
+// about given LB Node changes because of results of other instances.
+func (g *Gossip) Subscribe(key string) chan bool {
+	defer g.Unlock()
+	g.Lock()
+	ch := make(chan bool, 1)
+	g.subscribers[key] = ch
+	return ch
+}
+
+// Decide stores local health of LB Node and returns if it is up according
+// to all observers.
+func (g *Gossip) Decide(key string, localUp bool) bool {
+	defer g.Unlock()
+	g.Lock()
+	g.local[key] = localUp
+	up := g.decide(key)
+	g.decisions[key] = up
+	return up
+}
+
+// decide counts votes of all observers of LB Node. Gossip must be locked.
+func (g *Gossip) decide(key string) bool {
+	localUp := g.local[key]
+	observers, down := 1, 0
+	if localUp == false {
+		down++
+	}
+
+	now := time.Now()
+	for _, peer := range g.remote {
+		if now.Sub(peer.seen) > g.timeout {
+			continue
+		}
+		if up, ok := peer.results[key]; ok {
+			observers++
+			if up == false {
+				down++
+			}
+		}
+	}
+
+	// Not enough observers, decide alone.
+	if observers < g.quorum {
+		return localUp
+	}
+	return down < g.quorum
+}
+
+// reevaluate notifies subscribers of LB Nodes whose decision has changed.
+// Gossip must be locked.
+func (g *Gossip) reevaluate() {
+	for key := range g.local {
+		up := g.decide(key)
+		if up == g.decisions[key] {
+			continue
+		}
+		g.decisions[key] = up
+		if ch, ok := g.subscribers[key]; ok {
+			select {
+			case ch <- true:
+			default:
+			}
+		}
+	}
+}
+
+// sign returns HMAC of payload.
+func sign(key []byte, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// send sends local results to all peers.
+func (g *Gossip) send() {
+	g.Lock()
+	msg := message{Name: g.name, Time: time.Now().UnixNano(), Results: map[string]bool{}}
+	for key, up := range g.local {
+		msg.Results[key] = up
+	}
+	key, peers := g.key, g.peers
+	g.Unlock()
+
+	payload, _ := json.Marshal(msg)
+	packet := append(sign(key, payload), payload...)
+	if len(packet) > maxPacketSize {
+		logger.Error.Printf(g.logPrefix+"message of %d bytes is too large", len(packet))
+		return
+	}
+	for _, peer := range peers {
+		if _, err := g.conn.WriteToUDP(packet, peer); err != nil {
+			logger.Debug.Printf(g.logPrefix+"peer: %s %v", peer, err)
+		}
+	}
+}
+
+// receive handles messages from peers until the socket is closed.
+func (g *Gossip) receive() {
+	defer g.stopped.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-g.stopChan:
+				return
+			default:
+			}
+			logger.Error.Printf(g.logPrefix+"%v", err)
+			continue
+		}
+		if err := g.handle(buf[:n]); err != nil {
+			logger.Warning.Printf(g.logPrefix+"from: %s %v", addr, err)
+		}
+	}
+}
+
+// handle verifies message from peer and stores its results.
+func (g *Gossip) handle(packet []byte) error {
+	defer g.Unlock()
+	g.Lock()
+
+	if len(packet) < sha256.Size {
+		return fmt.Errorf("message too short")
+	}
+	mac, payload := packet[:sha256.Size], packet[sha256.Size:]
+	if hmac.Equal(mac, sign(g.key, payload)) == false {
+		return fmt.Errorf("message not authenticated")
+	}
+
+	var msg message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+	if msg.Name == g.name {
+		return nil
+	}
+	skew := time.Since(time.Unix(0, msg.Time))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return fmt.Errorf("message from %s is %s old", msg.Name, skew)
+	}
+
+	peer, ok := g.remote[msg.Name]
+	if !ok {
+		peer = new(peerState)
+		g.remote[msg.Name] = peer
+	}
+	if msg.Time <= peer.time {
+		return fmt.Errorf("message from %s replayed or reordered", msg.Name)
+	}
+	if peer.results == nil {
+		logger.Info.Printf(g.logPrefix+"peer: %s joined", msg.Name)
+	}
+	peer.time = msg.Time
+	peer.seen = time.Now()
+	peer.results = msg.Results
+	g.reevaluate()
+	return nil
+}
+
+// run sends results to peers every interval and forgets results of peers
+// which went silent. Time of their last message is kept, so that it can not
+// be replayed within maxClockSkew.
+func (g *Gossip) run() {
+	defer g.stopped.Done()
+	g.Lock()
+	interval := g.interval
+	g.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if g.dryRun == false {
+			g.send()
+		}
+		select {
+		case <-ticker.C:
+		case <-g.stopChan:
+			return
+		}
+
+		g.Lock()
+		for name, peer := range g.remote {
+			if peer.results != nil && time.Since(peer.seen) > g.timeout {
+				logger.Warning.Printf(g.logPrefix+"peer: %s unreachable, deciding without it", name)
+				peer.results = nil
+			}
+		}
+		g.reevaluate()
+		if g.interval != interval {
+			interval = g.interval
+			ticker.Reset(interval)
+		}
+		g.Unlock()
+	}
+}
+
+// Stop terminates exchanging of results and waits until it is done.
+func (g *Gossip) Stop() {
+	close(g.stopChan)
+	g.conn.Close()
+	g.stopped.Wait()
+}
@@ -0,0 +1,253 @@
+package gossip
+
+import (
+	"encoding/json"
+	"github.com/innogames/yacht/logger"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKey = "web/node1"
+
+// gossipConfig returns configuration of instance listening on any free port
+// of localhost with given peers.
+func gossipConfig(name string, key string, quorum int, peers ...*Gossip) map[string]interface{} {
+	var peerAddrs []interface{}
+	for _, peer := range peers {
+		peerAddrs = append(peerAddrs, peer.conn.LocalAddr().String())
+	}
+	return map[string]interface{}{
+		"listen":   "127.0.0.1:0",
+		"name":     name,
+		"key":      key,
+		"quorum":   float64(quorum),
+		"interval": 0.02,
+		"timeout":  0.3,
+		"peers":    peerAddrs,
+	}
+}
+
+// newMesh starts instances with given names, all of them peers of each other.
+func newMesh(t *testing.T, quorum int, names ...string) []*Gossip {
+	var mesh []*Gossip
+	for _, name := range names {
+		g := NewGossip(gossipConfig(name, "secret", quorum), false)
+		if g == nil {
+			t.Fatalf("gossip %s not created", name)
+		}
+		mesh = append(mesh, g)
+	}
+	// Listen ports are known only now, tell everyone about others.
+	for i, g := range mesh {
+		var peers []*Gossip
+		for j, peer := range mesh {
+			if i != j {
+				peers = append(peers, peer)
+			}
+		}
+		if g.Reconfigure(gossipConfig(names[i], "secret", quorum, peers...)) == false {
+			t.Fatalf("gossip %s not reconfigured", names[i])
+		}
+	}
+	return mesh
+}
+
+// waitDecision decides with local result until given decision is reached.
+func waitDecision(t *testing.T, g *Gossip, localUp bool, want bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for g.Decide(testKey, localUp) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: decision with local %v did not become %v", g.name, localUp, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// packet builds message signed with given key.
+func packet(t *testing.T, key string, msg message) []byte {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(sign([]byte(key), payload), payload...)
+}
+
+func TestQuorumDown(t *testing.T) {
+	logger.InitLoggers(false)
+
+	mesh := newMesh(t, 2, "a", "b", "c")
+	for _, g := range mesh {
+		defer g.Stop()
+	}
+	a, b, c := mesh[0], mesh[1], mesh[2]
+	notify := c.Subscribe(testKey)
+
+	// Single observer seeing LB Node down is outvoted.
+	a.Decide(testKey, false)
+	b.Decide(testKey, true)
+	waitDecision(t, c, true, true)
+	waitDecision(t, a, false, true)
+
+	// Quorum of observers takes LB Node down also where it looks fine.
+	b.Decide(testKey, false)
+	waitDecision(t, c, true, false)
+	select {
+	case <-notify:
+	default:
+		t.Error("subscriber not notified about decision")
+	}
+
+	// Quorum is changed on reload.
+	if c.Reconfigure(gossipConfig("c", "secret", 3, a, b)) == false {
+		t.Fatal("gossip not reconfigured")
+	}
+	waitDecision(t, c, true, true)
+}
+
+func TestLocalFallback(t *testing.T) {
+	logger.InitLoggers(false)
+
+	mesh := newMesh(t, 2, "a", "b")
+	a, b := mesh[0], mesh[1]
+	defer b.Stop()
+
+	a.Decide(testKey, true)
+	waitDecision(t, b, false, true)
+
+	// Without peer there are not enough observers, local result decides.
+	a.Stop()
+	waitDecision(t, b, false, false)
+}
+
+func TestBadHMAC(t *testing.T) {
+	logger.InitLoggers(false)
+
+	mesh := newMesh(t, 2, "a", "b")
+	for _, g := range mesh {
+		defer g.Stop()
+	}
+	a, b := mesh[0], mesh[1]
+
+	// Peer with a different key is ignored.
+	if b.Reconfigure(gossipConfig("b", "other", 2, a)) == false {
+		t.Fatal("gossip not reconfigured")
+	}
+	b.Decide(testKey, false)
+	time.Sleep(200 * time.Millisecond)
+	if a.Decide(testKey, true) == false {
+		t.Error("result of peer with wrong key used")
+	}
+	a.Lock()
+	_, ok := a.remote["b"]
+	a.Unlock()
+	if ok {
+		t.Error("peer with wrong key joined")
+	}
+
+	msg := message{Name: "x", Time: time.Now().UnixNano(), Results: map[string]bool{testKey: false}}
+	if err := a.handle(packet(t, "other", msg)); err == nil || strings.Contains(err.Error(), "not authenticated") == false {
+		t.Errorf("message with bad HMAC accepted: %v", err)
+	}
+	if err := a.handle([]byte("short")); err == nil {
+		t.Error("short message accepted")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	logger.InitLoggers(false)
+
+	g := NewGossip(gossipConfig("a", "secret", 2), false)
+	if g == nil {
+		t.Fatal("gossip not created")
+	}
+	defer g.Stop()
+
+	downPacket := packet(t, "secret", message{Name: "x", Time: time.Now().UnixNano(), Results: map[string]bool{testKey: false}})
+	upPacket := packet(t, "secret", message{Name: "x", Time: time.Now().UnixNano() + 1, Results: map[string]bool{testKey: true}})
+	if err := g.handle(downPacket); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.handle(upPacket); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.handle(downPacket); err == nil || strings.Contains(err.Error(), "replayed") == false {
+		t.Errorf("replayed message accepted: %v", err)
+	}
+	g.Lock()
+	up, ok := g.remote["x"].results[testKey]
+	g.Unlock()
+	if !ok || up == false {
+		t.Error("replayed message changed results")
+	}
+
+	old := packet(t, "secret", message{Name: "y", Time: time.Now().Add(-time.Hour).UnixNano(), Results: map[string]bool{}})
+	if err := g.handle(old); err == nil {
+		t.Error("old message accepted")
+	}
+}
+
+func TestDryRunDoesNotSend(t *testing.T) {
+	logger.InitLoggers(false)
+
+	dry := NewGossip(gossipConfig("dry", "secret", 1), true)
+	prod := NewGossip(gossipConfig("prod", "secret", 1), false)
+	if dry == nil || prod == nil {
+		t.Fatal("gossip not created")
+	}
+	defer dry.Stop()
+	defer prod.Stop()
+	dry.Reconfigure(gossipConfig("dry", "secret", 1, prod))
+	prod.Reconfigure(gossipConfig("prod", "secret", 1, dry))
+
+	// Dry run instance hears the production one, but never counts for it.
+	dry.Decide(testKey, false)
+	prod.Decide(testKey, false)
+	waitDecision(t, dry, true, false)
+	time.Sleep(100 * time.Millisecond)
+	if prod.Decide(testKey, true) == false {
+		t.Error("result of dry run instance used")
+	}
+	prod.Lock()
+	_, ok := prod.remote["dry"]
+	prod.Unlock()
+	if ok {
+		t.Error("results of dry run instance received")
+	}
+}
+
+func TestReplayAfterTimeout(t *testing.T) {
+	logger.InitLoggers(false)
+
+	g := NewGossip(gossipConfig("a", "secret", 1), false)
+	if g == nil {
+		t.Fatal("gossip not created")
+	}
+	defer g.Stop()
+
+	down := packet(t, "secret", message{Name: "x", Time: time.Now().UnixNano(), Results: map[string]bool{testKey: false}})
+	if err := g.handle(down); err != nil {
+		t.Fatal(err)
+	}
+	waitDecision(t, g, true, false)
+
+	// Peer times out, its results are forgotten.
+	waitDecision(t, g, true, true)
+
+	// Captured message must not bring it back, although it is not too old.
+	if err := g.handle(down); err == nil || strings.Contains(err.Error(), "replayed") == false {
+		t.Errorf("replayed message of timed out peer accepted: %v", err)
+	}
+	if g.Decide(testKey, true) == false {
+		t.Error("replayed message of timed out peer used")
+	}
+
+	// Newer message of the peer is accepted again.
+	newer := packet(t, "secret", message{Name: "x", Time: time.Now().UnixNano(), Results: map[string]bool{testKey: false}})
+	if err := g.handle(newer); err != nil {
+		t.Fatal(err)
+	}
+	if g.Decide(testKey, true) {
+		t.Error("result of returned peer not used")
+	}
+}
@@ -0,0 +1,150 @@
+package lbpool
+
+import (
+	"fmt"
+	"github.com/innogames/yacht/logger"
+)
+
+// Possible values of depends_action, telling what to do with LB Pool when
+// any of LB Pools it depends on is not serviceable.
+const (
+	// DependsForceDown removes all nodes from LB Pool
+	DependsForceDown = "force_down"
+	// DependsBackupPool switches traffic to backup nodes of LB Pool
+	DependsBackupPool = "backup_pool"
+	// DependsAlert only logs a warning
+	DependsAlert = "alert"
+)
+
+// CheckDependencies verifies that depends_on of LB Pools in JSON configuration
+// points only to existing LB Pools and that there are no cycles between them.
+func CheckDependencies(json map[string]interface{}) error {
+	graph := map[string][]string{}
+	for poolName, poolConfig := range json {
+		poolConfigMap, _ := poolConfig.(map[string]interface{})
+		dependsOn, _ := poolConfigMap["depends_on"].([]interface{})
+		for _, dep := range dependsOn {
+			depName, ok := dep.(string)
+			if !ok {
+				return fmt.Errorf("lb_pool: %s depends_on must be a list of names", poolName)
+			}
+			if _, ok := json[depName]; !ok {
+				return fmt.Errorf("lb_pool: %s depends on unknown lb_pool %s", poolName, depName)
+			}
+			graph[poolName] = append(graph[poolName], depName)
+		}
+	}
+
+	// Depth-first search, a pool found again on current path means a cycle.
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	visited := map[string]int{}
+	var visit func(poolName string, path []string) error
+	visit = func(poolName string, path []string) error {
+		switch visited[poolName] {
+		case onPath:
+			return fmt.Errorf("lb_pool: dependency cycle %v", append(path, poolName))
+		case done:
+			return nil
+		}
+		visited[poolName] = onPath
+		for _, depName := range graph[poolName] {
+			if err := visit(depName, append(path, poolName)); err != nil {
+				return err
+			}
+		}
+		visited[poolName] = done
+		return nil
+	}
+	for poolName := range graph {
+		if err := visit(poolName, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LinkDependencies connects LB Pools with LB Pools they depend on. A LB Pool
+// depends on the LB Pool of the same protocol only. Missing ones are ignored,
+// for example when a dependency has no IP address for given protocol.
+func LinkDependencies(lbPools []*LBPool) {
+	for _, lbp := range lbPools {
+		for _, depName := range lbp.dependsOn {
+			for _, dep := range lbPools {
+				if dep.name == depName+"_"+lbp.proto {
+					lbp.dependencies = append(lbp.dependencies, dep)
+				}
+			}
+		}
+	}
+}
+
+// isServiceable tells if LB Pool has enough up nodes to serve traffic.
+func (lbp *LBPool) isServiceable() bool {
+	defer lbp.Unlock()
+	lbp.Lock()
+	return lbp.serviceable
+}
+
+// updateServiceable is called from poolLogic to remember if LB Pool is serviceable
+// for LB Pools which depend on it.
+func (lbp *LBPool) updateServiceable(wantedNodes []*LBNode) {
+	upNodes := 0
+	for _, lbn := range wantedNodes {
+		if lbn.state == NodeUp {
+			upNodes++
+		}
+	}
+	lbp.serviceable = upNodes > 0 && upNodes >= lbp.minNodes
+}
+
+// dependenciesOK checks if all LB Pools this one depends on are serviceable.
+// It must be called without this LB Pool being locked.
+func (lbp *LBPool) dependenciesOK() bool {
+	for _, dep := range lbp.dependencies {
+		if dep.isServiceable() == false {
+			return false
+		}
+	}
+	return true
+}
+
+// updateDependencies stores result of dependenciesOK. Returns true if it has
+// changed and poolLogic must be run again.
+func (lbp *LBPool) updateDependencies(depsOK bool) bool {
+	if depsOK == lbp.depsOK {
+		return false
+	}
+	lbp.depsOK = depsOK
+	if depsOK {
+		logger.Info.Printf(lbp.logPrefix+"dependencies serviceable again action: %s", lbp.dependsAction)
+	} else {
+		logger.Warning.Printf(lbp.logPrefix+"dependency not serviceable action: %s", lbp.dependsAction)
+	}
+	return lbp.dependsAction != DependsAlert
+}
+
+// applyDependencies modifies wanted nodes if any dependency is not serviceable.
+func (lbp *LBPool) applyDependencies(wantedNodes []*LBNode) []*LBNode {
+	if lbp.depsOK {
+		return wantedNodes
+	}
+
+	switch lbp.dependsAction {
+	case DependsForceDown:
+		return []*LBNode{}
+	case DependsBackupPool:
+		var backupNodes []*LBNode
+		for _, lbn := range lbp.lbNodes {
+			if lbn.primary == false && lbp.nodeUsable(lbn) {
+				backupNodes = append(backupNodes, lbn)
+			}
+		}
+		return backupNodes
+	}
+	return wantedNodes
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/innogames/yacht/logger"
 	"net"
 	"sync"
+	"time"
 )
 
 // LBNode represents one of nodes serving traffic in a loadbalancer. Here it stores
@@ -14,12 +15,23 @@ type LBNode struct {
 	// Configuration
 	name      string
 	ipAddress net.IP
+	weight    int
 
 	// Operation
 	hcsResults healthcheck.HCsResults
 	state      NodeState
 	primary    bool
 	reason     NodeReason
+	selected   bool
+
+	// Slow start
+	warming     bool
+	warmupUntil time.Time
+
+	// Shared decision with other instances
+	quorum     Quorum
+	quorumKey  string
+	quorumChan chan bool
 
 	// Communication
 	logPrefix    string
@@ -51,6 +63,18 @@ func newLBNode(lbPool *LBPool, logPrefix string, proto string, name string, node
 	lbNode.state = NodeUnknown
 	lbNode.reason = ReasonNone
 	lbNode.primary = true
+	lbNode.weight = 1
+	// Node with weight 0 would never get traffic from weighted backends.
+	if weight, ok := nodeConfig["weight"].(float64); ok {
+		if weight >= 1 {
+			lbNode.weight = int(weight)
+		} else {
+			logger.Error.Printf(lbNode.logPrefix+"invalid weight %v, using %d", weight, lbNode.weight)
+		}
+	}
+	if backup, ok := nodeConfig["backup"].(bool); ok && backup {
+		lbNode.primary = false
+	}
 
 	logger.Info.Printf(lbNode.logPrefix + "created")
 
@@ -84,25 +108,45 @@ func newLBNode(lbPool *LBPool, logPrefix string, proto string, name string, node
 
 // nodeLogic is trigerred when state of any of HCs of this Node changes.
 // Access to this LB Node must be protected because it can be accessed from
-// another node's run() for lbPool.poolLogic()
+// another node's run() for lbPool.poolLogic(). Linked LB Pools share the lock.
 func (lbn *LBNode) nodeLogic(hcrm healthcheck.HCResultMsg) {
 	defer lbn.lbPool.Unlock()
 	lbn.lbPool.Lock()
 
 	lbn.hcsResults.Update(hcrm)
+	lbn.updateState()
+}
+
+// updateState changes state of LB Node according to results of its HCs and,
+// if LB Node uses Quorum, results of other observers.
+// LB Pool must be already locked.
+func (lbn *LBNode) updateState() {
 	goodHCs, allHCs, unknownHCs := lbn.hcsResults.GoodHCs()
 
 	// Do not perform any actions untill all HCs report at least once!
 	if unknownHCs == 0 {
-		if goodHCs == allHCs && lbn.state != NodeUp {
-			logger.Info.Printf(lbn.logPrefix+"%d/%d healthchecks good action: up", goodHCs, allHCs)
+		up := goodHCs == allHCs
+		quorum := ""
+		if lbn.quorum != nil {
+			if quorumUp := lbn.quorum.Decide(lbn.quorumKey, up); quorumUp != up {
+				quorum = " overruled by quorum"
+				up = quorumUp
+			}
+		}
+
+		if up && lbn.state != NodeUp {
+			logger.Info.Printf(lbn.logPrefix+"%d/%d healthchecks good%s action: up", goodHCs, allHCs, quorum)
+			if lbn.state == NodeDown {
+				lbn.startWarmup()
+			}
 			lbn.state = NodeUp
-			lbn.lbPool.poolLogic(lbn)
-		} else if goodHCs != allHCs && lbn.state != NodeDown {
-			logger.Info.Printf(lbn.logPrefix+"%d/%d healthchecks good action: down", goodHCs, allHCs)
+			lbn.lbPool.runPoolLogic(lbn)
+		} else if up == false && lbn.state != NodeDown {
+			logger.Info.Printf(lbn.logPrefix+"%d/%d healthchecks good%s action: down", goodHCs, allHCs, quorum)
 			lbn.reason = ReasonNone
+			lbn.stopWarmup()
 			lbn.state = NodeDown
-			lbn.lbPool.poolLogic(lbn)
+			lbn.lbPool.runPoolLogic(lbn)
 		}
 	}
 }
@@ -119,6 +163,11 @@ func (lbn *LBNode) run(wg *sync.WaitGroup) {
 		// Message from one of Healthchecks about reaching a hard state.
 		case hcrm := <-lbn.hcChan:
 			lbn.nodeLogic(hcrm)
+		// Message from Quorum: other observers changed decision.
+		case <-lbn.quorumChan:
+			lbn.lbPool.Lock()
+			lbn.updateState()
+			lbn.lbPool.Unlock()
 		// Message from parent (LB Pool): stop running.
 		case <-lbn.stopChan:
 			return
@@ -0,0 +1,28 @@
+package lbpool
+
+import (
+	"github.com/innogames/yacht/logger"
+	"testing"
+)
+
+func TestLBNodeWeight(t *testing.T) {
+	logger.InitLoggers(false)
+
+	for weight, want := range map[interface{}]int{
+		nil:  1,
+		5.0:  5,
+		1.0:  1,
+		0.0:  1,
+		0.5:  1,
+		-3.0: 1,
+	} {
+		nodeConfig := map[string]interface{}{"ip4": "192.0.2.10"}
+		if weight != nil {
+			nodeConfig["weight"] = weight
+		}
+		lbn := newLBNode(nil, "", "4", "node1", nodeConfig, []interface{}{})
+		if lbn.weight != want {
+			t.Errorf("weight %v: got %d, want %d", weight, lbn.weight, want)
+		}
+	}
+}
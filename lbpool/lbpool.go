@@ -5,28 +5,50 @@ import (
 	"github.com/innogames/yacht/logger"
 	"net"
 	"sync"
+	"time"
 )
 
 // LBPool represents the object which receives the traffic and balances it between nodes.
 type LBPool struct {
 	// Properties
 	name           string
+	baseName       string
+	proto          string
 	ipAddress      string
 	lbNodes        []*LBNode
 	pfName         string
 	minNodes       int
 	maxNodes       int
 	minNodesAction MinNodesAction
+	removalLimit   *removalLimit
+	syncState      *syncState
+	warmup         time.Duration
+	killStates     string
+	killGrace      time.Duration
+	dependsOn      []string
+	dependsAction  string
+	linkProtocols  bool
+	backend        string
+	backendOptions map[string]interface{}
+	bgpOptions     map[string]interface{}
+	vipInterface   string
 
 	// Operation
-	sync.Mutex
+	*sync.Mutex
 	wantedNodes   []*LBNode
 	wantedChanged bool
+	serviceable   bool
+	decided       bool
+	dependencies  []*LBPool
+	depsOK        bool
+	linked        *LBPool
+	leader        bool
 
 	// Communication
-	logPrefix string
-	nodeChan  chan NodeStateMsg
-	stopChan  chan bool
+	logPrefix   string
+	nodeChan    chan NodeStateMsg
+	stopChan    chan bool
+	subscribers []chan bool
 }
 
 // NewLBPool is a object factory which creates new LBPool using configuration from JSON.
@@ -40,8 +62,11 @@ func NewLBPool(proto string, name string, json map[string]interface{}) *LBPool {
 
 	// Initialize new LB Pool
 	lbPool := new(LBPool)
+	lbPool.Mutex = new(sync.Mutex)
 	lbPool.stopChan = make(chan bool)
 	lbPool.name = name + "_" + proto
+	lbPool.baseName = name
+	lbPool.proto = proto
 	lbPool.pfName = json["pf_name"].(string) + "_" + proto
 	lbPool.ipAddress = ipAddress.(string)
 	lbPool.logPrefix = fmt.Sprintf("lb_pool: %s ", lbPool.name)
@@ -63,6 +88,60 @@ func NewLBPool(proto string, name string, json map[string]interface{}) *LBPool {
 		lbPool.maxNodes = lbPool.minNodes
 	}
 
+	lbPool.removalLimit = newRemovalLimit(json)
+
+	// Recovering nodes are held back for warm-up period.
+	if warmup, ok := json["warmup"].(float64); ok && warmup > 0 {
+		lbPool.warmup = time.Duration(warmup) * time.Second
+	}
+
+	// Configure killing of states to nodes removed from table.
+	if killStates, ok := json["kill_states"].(string); ok {
+		switch killStates {
+		case KillNone, KillStates, KillSources:
+			lbPool.killStates = killStates
+		default:
+			logger.Error.Printf(lbPool.logPrefix+"unknown kill_states %s", killStates)
+		}
+	}
+	if killGrace, ok := json["kill_states_grace"].(float64); ok && killGrace > 0 {
+		lbPool.killGrace = time.Duration(killGrace) * time.Second
+	}
+
+	// Configure dependencies on other LB Pools, they are linked later
+	// when all LB Pools are created.
+	lbPool.serviceable = true
+	lbPool.depsOK = true
+	lbPool.dependsAction = DependsAlert
+	if dependsOn, ok := json["depends_on"].([]interface{}); ok {
+		for _, dep := range dependsOn {
+			lbPool.dependsOn = append(lbPool.dependsOn, dep.(string))
+		}
+	}
+	if dependsAction, ok := json["depends_action"].(string); ok {
+		switch dependsAction {
+		case DependsForceDown, DependsBackupPool, DependsAlert:
+			lbPool.dependsAction = dependsAction
+		default:
+			logger.Error.Printf(lbPool.logPrefix+"unknown depends_action %s", dependsAction)
+		}
+	}
+
+	// IPv4 and IPv6 LB Pools can be linked together, see LinkProtocols.
+	if linkProtocols, ok := json["link_protocols"].(bool); ok {
+		lbPool.linkProtocols = linkProtocols
+	}
+
+	// Backend to which wanted nodes are applied, pf by default.
+	lbPool.backend = DefaultBackend
+	if backend, ok := json["backend"].(string); ok {
+		lbPool.backend = backend
+	}
+	lbPool.backendOptions, _ = json["backend_options"].(map[string]interface{})
+	lbPool.syncState = newSyncState(json)
+	lbPool.bgpOptions, _ = json["bgp"].(map[string]interface{})
+	lbPool.vipInterface, _ = json["vip_interface"].(string)
+
 	logger.Info.Printf(lbPool.logPrefix+"min %d max %d created", lbPool.minNodes, lbPool.maxNodes)
 
 	// Configuration of Healthchecks for this LB Pool will be passed to all nodes.
@@ -81,27 +160,31 @@ func NewLBPool(proto string, name string, json map[string]interface{}) *LBPool {
 
 // poolLogic handles adding and removing nodes.
 // It is called from LB Node which should have already locked LB Pool struct.
+// When retrying queued removals it is called from LB Pool itself with nil lbNode.
 func (lbp *LBPool) poolLogic(lbNode *LBNode) {
 	// First check if state of all Nodes is known
-	for _, lbn := range lbp.lbNodes {
-		if lbn.state == NodeUnknown {
-			return
-		}
+	if lbp.allNodesKnown() == false {
+		return
 	}
 
 	// Mark wanted set as dirty.
 	lbp.wantedChanged = true
+	lbp.decided = true
 
 	var upNodes, forcedNodes, allNodes int
 	var wantedNodes []*LBNode
 
 	// Add nodes while satisfying maxNodes if it is set. First add
 	// nodes which were added before in order to avoid rebalancing.
+	for _, lbn := range lbp.lbNodes {
+		lbn.selected = false
+	}
 	for _, lbn := range lbp.lbNodes {
 		if lbn.reason == ReasonMaxNodes {
 			allNodes++
-			if lbn.primary && lbn.state == NodeUp && (lbp.maxNodes == 0 || upNodes < lbp.maxNodes) {
+			if lbp.selectable(lbn, upNodes) {
 				wantedNodes = append(wantedNodes, lbn)
+				lbn.selected = true
 				upNodes++
 			}
 		}
@@ -109,8 +192,9 @@ func (lbp *LBPool) poolLogic(lbNode *LBNode) {
 	for _, lbn := range lbp.lbNodes {
 		if lbn.reason != ReasonMaxNodes {
 			allNodes++
-			if lbn.primary && lbn.state == NodeUp && (lbp.maxNodes == 0 || upNodes < lbp.maxNodes) {
+			if lbp.selectable(lbn, upNodes) {
 				wantedNodes = append(wantedNodes, lbn)
+				lbn.selected = true
 				lbn.reason = ReasonMaxNodes
 				upNodes++
 			}
@@ -129,7 +213,7 @@ func (lbp *LBPool) poolLogic(lbNode *LBNode) {
 			// even if they are down. Start with node for which this function
 			// was called. This is the the last one which was alive, so let's
 			// not change loadbalancing.
-			if lbNode.primary {
+			if lbNode != nil && lbNode.primary {
 				wantedNodes = append(wantedNodes, lbNode)
 				forcedNodes++
 			}
@@ -142,7 +226,7 @@ func (lbp *LBPool) poolLogic(lbNode *LBNode) {
 			}
 		} else if lbp.minNodesAction == BackupPool {
 			for _, lbn := range lbp.lbNodes {
-				if lbn.primary == false && lbn.state == NodeUp {
+				if lbn.primary == false && lbp.nodeUsable(lbn) {
 					wantedNodes = append(wantedNodes, lbn)
 					forcedNodes++
 				}
@@ -150,7 +234,12 @@ func (lbp *LBPool) poolLogic(lbNode *LBNode) {
 		}
 	}
 
+	wantedNodes = lbp.applyDependencies(wantedNodes)
+	lbp.updateServiceable(wantedNodes)
+	wantedNodes = lbp.limitRemovals(wantedNodes)
+
 	lbp.wantedNodes = wantedNodes
+	lbp.notify()
 	logger.Info.Printf(lbp.logPrefix+"nodes: up %d forced %d min %d max %d all %d", upNodes, forcedNodes, lbp.minNodes, lbp.maxNodes, allNodes)
 	for _, node := range wantedNodes {
 		logger.Info.Printf(lbp.logPrefix+"lb_node: %s action: active", node.name)
@@ -158,29 +247,158 @@ func (lbp *LBPool) poolLogic(lbNode *LBNode) {
 }
 
 // GetWantedNodes returns information required to configure loadbalancing.
-// If there was no change, it returns nil as list.
+// If there was no change and neither retry nor reconciliation is due,
+// it returns nil as list.
 func (lbp *LBPool) GetWantedNodes() (string, []net.IP, string) {
 	defer lbp.Unlock()
 	lbp.Lock()
-	if lbp.wantedChanged == false {
+	if lbp.decided == false || lbp.syncState.due(lbp.wantedChanged) == false {
 		return lbp.pfName, nil, lbp.logPrefix
 	}
 	lbp.wantedChanged = false
-	var ret []net.IP
+	// Empty set must be applied too, so it is not nil.
+	ret := []net.IP{}
 	for _, lbn := range lbp.wantedNodes {
 		ret = append(ret, lbn.ipAddress)
 	}
 	return lbp.pfName, ret, lbp.logPrefix
 }
 
+// GetKillStates returns how states to nodes removed from LB Pool should be
+// killed and the grace period for nodes which have not failed.
+func (lbp *LBPool) GetKillStates() (string, time.Duration) {
+	return lbp.killStates, lbp.killGrace
+}
+
+// NodeFailed tells if LB Node with given address is down.
+func (lbp *LBPool) NodeFailed(ipAddress net.IP) bool {
+	defer lbp.Unlock()
+	lbp.Lock()
+	for _, lbn := range lbp.lbNodes {
+		if lbn.ipAddress.Equal(ipAddress) {
+			return lbn.state == NodeDown
+		}
+	}
+	return false
+}
+
+// GetName returns name of this LB Pool including protocol suffix.
+func (lbp *LBPool) GetName() string {
+	return lbp.name
+}
+
+// GetPFName returns name of pf table of this LB Pool.
+func (lbp *LBPool) GetPFName() string {
+	return lbp.pfName
+}
+
+// GetBaseName returns name of this LB Pool without protocol suffix.
+func (lbp *LBPool) GetBaseName() string {
+	return lbp.baseName
+}
+
+// GetLogPrefix returns prefix used for logging messages about this LB Pool.
+func (lbp *LBPool) GetLogPrefix() string {
+	return lbp.logPrefix
+}
+
+// GetBackendOptions returns configuration of this LB Pool specific to its backend.
+func (lbp *LBPool) GetBackendOptions() map[string]interface{} {
+	return lbp.backendOptions
+}
+
+// GetBGPOptions returns configuration of announcing this LB Pool over BGP.
+func (lbp *LBPool) GetBGPOptions() map[string]interface{} {
+	return lbp.bgpOptions
+}
+
+// GetVIPInterface returns name of local interface which gets IP address of this
+// LB Pool while it is serviceable. Empty if addresses are not managed.
+func (lbp *LBPool) GetVIPInterface() string {
+	return lbp.vipInterface
+}
+
+// GetServiceable tells if LB Pool has enough up nodes to serve traffic.
+// The second value is false until LB Pool has decided about its nodes.
+func (lbp *LBPool) GetServiceable() (bool, bool) {
+	defer lbp.Unlock()
+	lbp.Lock()
+	return lbp.serviceable, lbp.decided
+}
+
+// GetIPAddress returns IP address of this LB Pool.
+func (lbp *LBPool) GetIPAddress() net.IP {
+	return net.ParseIP(lbp.ipAddress)
+}
+
+// GetNodes returns information about all LB Nodes of this LB Pool.
+func (lbp *LBPool) GetNodes() []NodeInfo {
+	defer lbp.Unlock()
+	lbp.Lock()
+	var ret []NodeInfo
+	for _, lbn := range lbp.lbNodes {
+		ret = append(ret, NodeInfo{
+			Name:      lbn.name,
+			IPAddress: lbn.ipAddress,
+			Weight:    lbn.weight,
+			State:     lbn.state,
+			Primary:   lbn.primary,
+		})
+	}
+	return ret
+}
+
+// GetProto returns IP protocol version of this LB Pool, "4" or "6".
+func (lbp *LBPool) GetProto() string {
+	return lbp.proto
+}
+
+// GetBackend returns name of backend this LB Pool is applied to.
+func (lbp *LBPool) GetBackend() string {
+	return lbp.backend
+}
+
+// NodeCount returns number of all LB Nodes in this LB Pool.
+func (lbp *LBPool) NodeCount() int {
+	return len(lbp.lbNodes)
+}
+
+// MarkChanged forces wanted nodes to be returned again by GetWantedNodes.
+// It is used when they could not be applied.
+func (lbp *LBPool) MarkChanged() {
+	defer lbp.Unlock()
+	lbp.Lock()
+	lbp.wantedChanged = true
+}
+
 // Run is the main loop of LB Pool.
 func (lbp *LBPool) Run(wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer wg.Done()
 
 	// Start operation of all LB Nodes of this Pool.
 	for _, lbNode := range lbp.lbNodes {
 		go lbNode.run(wg)
 	}
 
+	for {
+		select {
+		// Retry removals which were queued because of removal limit,
+		// add nodes which have finished warm-up and react on changes
+		// of LB Pools this one depends on.
+		case <-time.After(time.Second):
+			depsOK := lbp.dependenciesOK()
+			lbp.Lock()
+			depsChanged := lbp.updateDependencies(depsOK)
+			if lbp.finishWarmups() || lbp.hasQueuedRemovals() || depsChanged {
+				lbp.runPoolLogic(nil)
+			}
+			lbp.Unlock()
+		// Message from main program: stop running.
+		case <-lbp.stopChan:
+			return
+		}
+	}
 }
 
 // Stop terminates operation of this LB Pool. It does it in proper order:
@@ -189,4 +407,8 @@ func (lbp *LBPool) Stop() {
 	for _, lbNode := range lbp.lbNodes {
 		lbNode.stop()
 	}
+	lbp.stopChan <- true
+	lbp.Lock()
+	lbp.stopSync()
+	lbp.Unlock()
 }
@@ -0,0 +1,102 @@
+package lbpool
+
+import (
+	"github.com/innogames/yacht/logger"
+)
+
+// LinkProtocols links IPv4 and IPv6 LB Pools created from the same configuration
+// entry if it has link_protocols enabled. Linked LB Pools share their lock, use
+// a LB Node only if it is healthy on both protocols and the IPv6 LB Pool follows
+// max_nodes selection of the IPv4 one. It must be called before LB Pools are run.
+func LinkProtocols(lbPools []*LBPool) {
+	for _, lbp := range lbPools {
+		if lbp.linkProtocols == false || lbp.proto != "4" {
+			continue
+		}
+		for _, sibling := range lbPools {
+			if sibling.proto == "6" && sibling.baseName == lbp.baseName {
+				lbp.linked = sibling
+				lbp.leader = true
+				sibling.linked = lbp
+				sibling.Mutex = lbp.Mutex
+				logger.Info.Printf(lbp.logPrefix+"linked with lb_pool: %s", sibling.name)
+			}
+		}
+	}
+}
+
+// counterpart returns LB Node of the same name in linked LB Pool.
+func (lbp *LBPool) counterpart(lbn *LBNode) *LBNode {
+	if lbp.linked == nil || lbn == nil {
+		return nil
+	}
+	for _, cp := range lbp.linked.lbNodes {
+		if cp.name == lbn.name {
+			return cp
+		}
+	}
+	return nil
+}
+
+// nodeUsable tells if LB Node is up and warm, also on the other protocol
+// if LB Pools are linked.
+func (lbp *LBPool) nodeUsable(lbn *LBNode) bool {
+	if lbn.state != NodeUp || lbn.isWarm() == false {
+		return false
+	}
+	if cp := lbp.counterpart(lbn); cp != nil {
+		return cp.state == NodeUp && cp.isWarm()
+	}
+	return true
+}
+
+// selectable tells if LB Node can be selected while satisfying maxNodes.
+// LB Nodes of the IPv6 LB Pool follow the selection done by the IPv4 one.
+func (lbp *LBPool) selectable(lbn *LBNode, upNodes int) bool {
+	if lbn.primary == false || lbp.nodeUsable(lbn) == false {
+		return false
+	}
+	if cp := lbp.counterpart(lbn); cp != nil && lbp.leader == false {
+		return cp.selected
+	}
+	return lbp.maxNodes == 0 || upNodes < lbp.maxNodes
+}
+
+// allNodesKnown tells if state of all LB Nodes is known, also in linked LB Pool.
+func (lbp *LBPool) allNodesKnown() bool {
+	lbPools := []*LBPool{lbp}
+	if lbp.linked != nil {
+		lbPools = append(lbPools, lbp.linked)
+	}
+	for _, pool := range lbPools {
+		for _, lbn := range pool.lbNodes {
+			if lbn.state == NodeUnknown {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// runPoolLogic runs poolLogic for this LB Pool and for the linked one.
+// IPv4 LB Pool always goes first because the IPv6 one follows its selection.
+func (lbp *LBPool) runPoolLogic(lbNode *LBNode) {
+	if lbp.linked == nil {
+		lbp.poolLogic(lbNode)
+		return
+	}
+
+	leader, follower := lbp, lbp.linked
+	if lbp.leader == false {
+		leader, follower = lbp.linked, lbp
+	}
+	// Counterpart is looked up by the LB Pool owning lbNode, it is found
+	// among LB Nodes of the linked one.
+	if lbNode != nil && lbNode.lbPool == leader {
+		leader.poolLogic(lbNode)
+		follower.poolLogic(leader.counterpart(lbNode))
+	} else {
+		leader.poolLogic(follower.counterpart(lbNode))
+		follower.poolLogic(lbNode)
+	}
+}
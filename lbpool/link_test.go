@@ -0,0 +1,88 @@
+package lbpool
+
+import (
+	"github.com/innogames/yacht/healthcheck"
+	"github.com/innogames/yacht/logger"
+	"testing"
+)
+
+func newLinkedLBPools(t *testing.T, json map[string]interface{}) (*LBPool, *LBPool) {
+	lbPool4 := NewLBPool("4", "web", json)
+	lbPool6 := NewLBPool("6", "web", json)
+	LinkProtocols([]*LBPool{lbPool4, lbPool6})
+	if lbPool4.linked != lbPool6 || lbPool6.linked != lbPool4 {
+		t.Fatal("LB Pools not linked")
+	}
+	return lbPool4, lbPool6
+}
+
+// setHealth sets results of all healthchecks of LB Node like they were
+// reported by them.
+func setHealth(lbn *LBNode, result healthcheck.HCResult) {
+	defer lbn.lbPool.Unlock()
+	lbn.lbPool.Lock()
+	for hc := range lbn.hcsResults {
+		lbn.hcsResults[hc] = result
+	}
+	lbn.updateState()
+}
+
+// checkWantedProto verifies that all wanted LB Nodes belong to LB Pool and
+// have address of its protocol.
+func checkWantedProto(t *testing.T, lbPool *LBPool) {
+	for _, lbn := range lbPool.wantedNodes {
+		if lbn.lbPool != lbPool {
+			t.Errorf("%swanted lb_node: %s of lb_pool: %s", lbPool.logPrefix, lbn.name, lbn.lbPool.name)
+		}
+		if (lbn.ipAddress.To4() != nil) != (lbPool.proto == "4") {
+			t.Errorf("%swanted lb_node: %s with address %s", lbPool.logPrefix, lbn.name, lbn.ipAddress)
+		}
+	}
+}
+
+func TestLinkedProtocolsKeepOwnNodes(t *testing.T) {
+	logger.InitLoggers(false)
+
+	lbPool4, lbPool6 := newLinkedLBPools(t, map[string]interface{}{
+		"ip4":            "192.0.2.1",
+		"ip6":            "2001:db8::1",
+		"pf_name":        "web",
+		"link_protocols": true,
+		"min_nodes":      2.0,
+		"healthchecks":   []interface{}{},
+		"nodes": map[string]interface{}{
+			"node1": map[string]interface{}{"ip4": "192.0.2.10", "ip6": "2001:db8::10"},
+			"node2": map[string]interface{}{"ip4": "192.0.2.11", "ip6": "2001:db8::11"},
+		},
+	})
+
+	var lbNodes []*LBNode
+	for _, lbPool := range []*LBPool{lbPool4, lbPool6} {
+		lbNodes = append(lbNodes, lbPool.lbNodes...)
+	}
+	for _, lbn := range lbNodes {
+		setHealth(lbn, healthcheck.HCGood)
+	}
+	for _, lbPool := range []*LBPool{lbPool4, lbPool6} {
+		checkWantedProto(t, lbPool)
+		if len(lbPool.wantedNodes) != 2 {
+			t.Errorf("%swanted %d nodes, want 2", lbPool.logPrefix, len(lbPool.wantedNodes))
+		}
+	}
+
+	// Node going down and up on either protocol changes both LB Pools.
+	// Below min_nodes the LB Node going down is forced up in both of them.
+	for _, lbn := range lbNodes {
+		setHealth(lbn, healthcheck.HCBad)
+		for _, lbPool := range []*LBPool{lbPool4, lbPool6} {
+			checkWantedProto(t, lbPool)
+		}
+		setHealth(lbn, healthcheck.HCGood)
+		for _, lbPool := range []*LBPool{lbPool4, lbPool6} {
+			checkWantedProto(t, lbPool)
+			if len(lbPool.wantedNodes) != 2 {
+				t.Errorf("%swanted %d nodes with %s up, want 2", lbPool.logPrefix, len(lbPool.wantedNodes), lbn.ipAddress)
+			}
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package lbpool
+
+// Quorum decides about state of LB Nodes together with other observers,
+// so that a LB Node is not marked down only because of network path of
+// this instance.
+type Quorum interface {
+	// Decide stores local health of LB Node and returns if it is up.
+	Decide(key string, localUp bool) bool
+	// Subscribe returns a channel notified when decision changes remotely.
+	Subscribe(key string) chan bool
+}
+
+// UseQuorum makes all LB Nodes of given LB Pools decide about their state
+// using Quorum. It must be called before LB Pools are run.
+func UseQuorum(lbPools []*LBPool, quorum Quorum) {
+	for _, lbPool := range lbPools {
+		for _, lbn := range lbPool.lbNodes {
+			lbn.quorum = quorum
+			lbn.quorumKey = lbPool.name + "/" + lbn.name
+			lbn.quorumChan = quorum.Subscribe(lbn.quorumKey)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package lbpool
+
+import (
+	"github.com/innogames/yacht/logger"
+	"time"
+)
+
+// removalLimit restricts how many LB Nodes can be removed from a LB Pool
+// within a time window. It protects against removing most of the Pool
+// because of a short hiccup of monitoring network.
+type removalLimit struct {
+	// Configuration
+	maxRemovals        int
+	maxRemovalsPercent float64
+	window             time.Duration
+
+	// Operation
+	removals []time.Time
+	queued   int
+}
+
+// newRemovalLimit creates removalLimit from LB Pool JSON configuration.
+// Returns nil if no limits are configured.
+func newRemovalLimit(json map[string]interface{}) *removalLimit {
+	rl := new(removalLimit)
+
+	if maxRemovals, ok := json["max_removals"].(float64); ok && maxRemovals > 0 {
+		rl.maxRemovals = int(maxRemovals)
+	}
+	if maxRemovalsPercent, ok := json["max_removals_percent"].(float64); ok && maxRemovalsPercent > 0 {
+		rl.maxRemovalsPercent = maxRemovalsPercent
+	}
+	if rl.maxRemovals == 0 && rl.maxRemovalsPercent == 0 {
+		return nil
+	}
+
+	rl.window = 60 * time.Second
+	if window, ok := json["removals_window"].(float64); ok && window > 0 {
+		rl.window = time.Duration(window) * time.Second
+	}
+
+	return rl
+}
+
+// allowed returns how many more removals can be performed now in a Pool of given size.
+// At least one removal per window is always allowed, so that small Pools are not frozen.
+func (rl *removalLimit) allowed(allNodes int) int {
+	now := time.Now()
+
+	// Forget removals which already left the window.
+	var removals []time.Time
+	for _, removal := range rl.removals {
+		if now.Sub(removal) < rl.window {
+			removals = append(removals, removal)
+		}
+	}
+	rl.removals = removals
+
+	limit := 0
+	if rl.maxRemovals > 0 {
+		limit = rl.maxRemovals
+	}
+	if rl.maxRemovalsPercent > 0 {
+		percentLimit := int(float64(allNodes) * rl.maxRemovalsPercent / 100)
+		if limit == 0 || percentLimit < limit {
+			limit = percentLimit
+		}
+	}
+	if limit < 1 {
+		limit = 1
+	}
+
+	if len(rl.removals) >= limit {
+		return 0
+	}
+	return limit - len(rl.removals)
+}
+
+// limitRemovals compares new wanted nodes with currently wanted nodes. Nodes
+// which would be removed above the limit are kept in wanted nodes and queued.
+// Queued removals are retried by the main loop of LB Pool.
+func (lbp *LBPool) limitRemovals(wantedNodes []*LBNode) []*LBNode {
+	rl := lbp.removalLimit
+	if rl == nil {
+		return wantedNodes
+	}
+
+	var removedNodes []*LBNode
+	for _, oldNode := range lbp.wantedNodes {
+		found := false
+		for _, newNode := range wantedNodes {
+			if oldNode == newNode {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			removedNodes = append(removedNodes, oldNode)
+		}
+	}
+
+	allowed := rl.allowed(len(lbp.lbNodes))
+	rl.queued = 0
+	for _, lbn := range removedNodes {
+		if allowed > 0 {
+			rl.removals = append(rl.removals, time.Now())
+			allowed--
+		} else {
+			logger.Warning.Printf(lbp.logPrefix+"lb_node: %s action: removal queued, limit reached", lbn.name)
+			wantedNodes = append(wantedNodes, lbn)
+			rl.queued++
+		}
+	}
+
+	return wantedNodes
+}
+
+// hasQueuedRemovals tells if there are any removals waiting for the window to pass.
+func (lbp *LBPool) hasQueuedRemovals() bool {
+	return lbp.removalLimit != nil && lbp.removalLimit.queued > 0
+}
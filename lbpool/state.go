@@ -1,5 +1,9 @@
 package lbpool
 
+import (
+	"net"
+)
+
 // NodeStateMsg represents if node is usable for serving traffic or not.
 type NodeStateMsg struct {
 	state  NodeState
@@ -18,6 +22,15 @@ const (
 	NodeUp
 )
 
+// NodeInfo describes LB Node for backends which need more than its address.
+type NodeInfo struct {
+	Name      string
+	IPAddress net.IP
+	Weight    int
+	State     NodeState
+	Primary   bool
+}
+
 // NodeReason keeps information why node was included or excluded
 type NodeReason int
 
@@ -28,6 +41,20 @@ const (
 	ReasonMaxNodes
 )
 
+// Possible values of kill_states, telling what to do with states of nodes
+// removed from LB Pool.
+const (
+	// KillNone leaves states until they expire
+	KillNone = ""
+	// KillStates kills states with pfctl -k
+	KillStates = "states"
+	// KillSources kills source tracking entries with pfctl -K
+	KillSources = "sources"
+)
+
+// DefaultBackend is name of backend used by LB Pools without backend configured.
+const DefaultBackend = "pf"
+
 // NodesStates is used to store state of many LN Nodes.
 type NodesStates map[*LBNode]NodeState
 
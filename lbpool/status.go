@@ -0,0 +1,28 @@
+package lbpool
+
+import (
+	"github.com/innogames/yacht/logger"
+	"time"
+)
+
+// LogStatus prints current status of this LB Pool and all of its LB Nodes.
+func (lbp *LBPool) LogStatus() {
+	defer lbp.Unlock()
+	lbp.Lock()
+
+	lastSync := "never"
+	if lbp.syncState.lastSync.IsZero() == false {
+		lastSync = lbp.syncState.lastSync.Format(time.RFC3339)
+	}
+	logger.Info.Printf(lbp.logPrefix+"status: wanted %d all %d last sync: %s sync errors: %d", len(lbp.wantedNodes), len(lbp.lbNodes), lastSync, lbp.syncState.errors)
+	for _, lbn := range lbp.lbNodes {
+		active := false
+		for _, wanted := range lbp.wantedNodes {
+			if wanted == lbn {
+				active = true
+				break
+			}
+		}
+		logger.Info.Printf(lbn.logPrefix+"status: %s active: %t primary: %t warm-up: %d%%", lbn.state, active, lbn.primary, lbn.warmupProgress())
+	}
+}
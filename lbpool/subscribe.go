@@ -0,0 +1,45 @@
+package lbpool
+
+import (
+	"net"
+)
+
+// Subscribe returns a channel which receives a message whenever wanted nodes
+// of this LB Pool change. Messages are not queued, a subscriber busy with
+// previous change gets only one message for all changes done meanwhile.
+func (lbp *LBPool) Subscribe() chan bool {
+	ch := make(chan bool, 1)
+	lbp.SubscribeChan(ch)
+	return ch
+}
+
+// SubscribeChan adds given channel to subscribers of this LB Pool, so that
+// one channel can be shared by many LB Pools. It should be buffered.
+func (lbp *LBPool) SubscribeChan(ch chan bool) {
+	defer lbp.Unlock()
+	lbp.Lock()
+	lbp.subscribers = append(lbp.subscribers, ch)
+}
+
+// notify tells all subscribers that wanted nodes have changed.
+// LB Pool must be already locked.
+func (lbp *LBPool) notify() {
+	for _, ch := range lbp.subscribers {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+}
+
+// GetWantedAddresses returns addresses of wanted nodes. Unlike GetWantedNodes
+// it does not touch the change flag, so it can be used by any subscriber.
+func (lbp *LBPool) GetWantedAddresses() []net.IP {
+	defer lbp.Unlock()
+	lbp.Lock()
+	var ret []net.IP
+	for _, lbn := range lbp.wantedNodes {
+		ret = append(ret, lbn.ipAddress)
+	}
+	return ret
+}
@@ -0,0 +1,118 @@
+package lbpool
+
+import (
+	"github.com/innogames/yacht/logger"
+	"time"
+)
+
+const (
+	// syncBackoffMin is delay before first retry of failed sync.
+	syncBackoffMin = time.Second
+	// syncBackoffMax is maximum delay between retries of failed sync.
+	syncBackoffMax = time.Minute
+	// defaultReconcileInterval is how often wanted nodes are applied even without changes.
+	defaultReconcileInterval = 60 * time.Second
+)
+
+// syncState tracks how wanted nodes of LB Pool were applied to its backend.
+// Failed syncs are retried with exponential backoff and wanted nodes are
+// periodically applied again, so that hand edits and lost changes are corrected.
+// Subscribers are notified by a timer when retry or reconciliation is due.
+type syncState struct {
+	// Configuration
+	reconcileInterval time.Duration
+
+	// Operation
+	lastSync    time.Time
+	errors      int
+	failures    int
+	retryAt     time.Time
+	reconcileAt time.Time
+	timer       *time.Timer
+}
+
+// newSyncState creates syncState from LB Pool JSON configuration.
+// Periodic reconciliation is disabled with reconcile_interval of 0.
+func newSyncState(json map[string]interface{}) *syncState {
+	ss := new(syncState)
+	ss.reconcileInterval = defaultReconcileInterval
+	if reconcileInterval, ok := json["reconcile_interval"].(float64); ok && reconcileInterval >= 0 {
+		ss.reconcileInterval = time.Duration(reconcileInterval) * time.Second
+	}
+	return ss
+}
+
+// due tells if wanted nodes should be applied now.
+func (ss *syncState) due(changed bool) bool {
+	now := time.Now()
+	if now.Before(ss.retryAt) {
+		return false
+	}
+	if changed {
+		return true
+	}
+	return ss.reconcileInterval > 0 && now.After(ss.reconcileAt)
+}
+
+// scheduleSync notifies subscribers of LB Pool at given time, replacing
+// previously scheduled notification. LB Pool must be already locked.
+func (lbp *LBPool) scheduleSync(at time.Time) {
+	if lbp.syncState.timer != nil {
+		lbp.syncState.timer.Stop()
+	}
+	lbp.syncState.timer = time.AfterFunc(time.Until(at), func() {
+		defer lbp.Unlock()
+		lbp.Lock()
+		lbp.notify()
+	})
+}
+
+// stopSync cancels scheduled notification. LB Pool must be already locked.
+func (lbp *LBPool) stopSync() {
+	if lbp.syncState.timer != nil {
+		lbp.syncState.timer.Stop()
+		lbp.syncState.timer = nil
+	}
+}
+
+// SyncFailed is called when wanted nodes could not be applied. LB Pool stays
+// dirty and applying is retried after backoff growing with each failure.
+func (lbp *LBPool) SyncFailed() {
+	defer lbp.Unlock()
+	lbp.Lock()
+
+	ss := lbp.syncState
+	ss.errors++
+	ss.failures++
+	backoff := syncBackoffMin
+	for i := 1; i < ss.failures && backoff < syncBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > syncBackoffMax {
+		backoff = syncBackoffMax
+	}
+	ss.retryAt = time.Now().Add(backoff)
+	lbp.wantedChanged = true
+	lbp.scheduleSync(ss.retryAt)
+	logger.Warning.Printf(lbp.logPrefix+"sync failed %d times, retrying in %s", ss.failures, backoff)
+}
+
+// SyncSucceeded is called when wanted nodes were applied.
+func (lbp *LBPool) SyncSucceeded() {
+	defer lbp.Unlock()
+	lbp.Lock()
+
+	ss := lbp.syncState
+	if ss.failures > 0 {
+		logger.Info.Printf(lbp.logPrefix+"sync recovered after %d failures", ss.failures)
+	}
+	ss.failures = 0
+	ss.retryAt = time.Time{}
+	ss.lastSync = time.Now()
+	ss.reconcileAt = ss.lastSync.Add(ss.reconcileInterval)
+	if ss.reconcileInterval > 0 {
+		lbp.scheduleSync(ss.reconcileAt)
+	} else {
+		lbp.stopSync()
+	}
+}
@@ -0,0 +1,54 @@
+package lbpool
+
+import (
+	"github.com/innogames/yacht/logger"
+	"time"
+)
+
+// startWarmup is called when LB Node recovers from NodeDown to NodeUp. Such node
+// is held back from wanted nodes until it has been healthy for warm-up period of
+// its LB Pool. Nodes going up for the first time after start are not held back.
+func (lbn *LBNode) startWarmup() {
+	if lbn.lbPool.warmup > 0 {
+		lbn.warmupUntil = time.Now().Add(lbn.lbPool.warmup)
+		lbn.warming = true
+		logger.Info.Printf(lbn.logPrefix+"warm-up for %s started", lbn.lbPool.warmup)
+	}
+}
+
+// stopWarmup is called when LB Node goes down during warm-up.
+func (lbn *LBNode) stopWarmup() {
+	lbn.warming = false
+}
+
+// isWarm tells if LB Node can be used for serving traffic.
+func (lbn *LBNode) isWarm() bool {
+	return lbn.warming == false
+}
+
+// warmupProgress returns warm-up progress of LB Node in percent.
+func (lbn *LBNode) warmupProgress() int {
+	if lbn.warming == false {
+		return 100
+	}
+	left := lbn.warmupUntil.Sub(time.Now())
+	if left <= 0 {
+		return 100
+	}
+	return int(100 - left*100/lbn.lbPool.warmup)
+}
+
+// finishWarmups ends warm-up of all LB Nodes which were healthy long enough.
+// Returns true if any of them has finished so that poolLogic can be run again.
+func (lbp *LBPool) finishWarmups() bool {
+	finished := false
+	now := time.Now()
+	for _, lbn := range lbp.lbNodes {
+		if lbn.warming && now.After(lbn.warmupUntil) {
+			lbn.warming = false
+			finished = true
+			logger.Info.Printf("%swarm-up finished", lbn.logPrefix)
+		}
+	}
+	return finished
+}
@@ -0,0 +1,156 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"github.com/innogames/yacht/logger"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkInterval is how long result of a check is valid.
+const checkInterval = time.Second
+
+// Leader tells if this instance is the active member of a redundant pair of
+// load balancers. Only the active member applies changes.
+type Leader struct {
+	sync.Mutex
+
+	// Configuration
+	checkType string
+	iface     string
+	vhid      int
+	path      string
+	value     string
+	command   string
+
+	// Operation
+	invalid   bool
+	active    bool
+	lastCheck time.Time
+}
+
+// NewLeader creates Leader from JSON configuration. Returns nil if no check
+// is configured, such instance is always active. Instance with invalid
+// configuration is never active, as it can not tell if the other one is.
+func NewLeader(json map[string]interface{}) *Leader {
+	if json == nil {
+		return nil
+	}
+
+	l := new(Leader)
+	l.checkType, _ = json["type"].(string)
+	l.iface, _ = json["interface"].(string)
+	if vhid, ok := json["vhid"].(float64); ok {
+		l.vhid = int(vhid)
+	}
+	l.path, _ = json["path"].(string)
+	l.value = "MASTER"
+	if value, ok := json["value"].(string); ok {
+		l.value = value
+	}
+	l.command, _ = json["command"].(string)
+
+	switch {
+	case l.checkType == "carp" && l.iface != "":
+	case l.checkType == "file" && l.path != "":
+	case l.checkType == "exec" && l.command != "":
+	default:
+		logger.Error.Printf("leader: invalid configuration, type must be carp with interface, file with path or exec with command, staying backup")
+		l.invalid = true
+		return l
+	}
+
+	logger.Info.Printf("leader: type: %s created", l.checkType)
+	return l
+}
+
+// IsActive tells if this instance is the active one. Failed check means backup.
+func (l *Leader) IsActive() bool {
+	defer l.Unlock()
+	l.Lock()
+
+	if l.invalid {
+		return false
+	}
+	if time.Since(l.lastCheck) < checkInterval {
+		return l.active
+	}
+	l.lastCheck = time.Now()
+
+	var active bool
+	var err error
+	switch l.checkType {
+	case "carp":
+		active, err = l.checkCarp()
+	case "file":
+		active, err = l.checkFile()
+	case "exec":
+		active, err = l.checkExec()
+	}
+	if err != nil {
+		logger.Error.Printf("leader: type: %s %v", l.checkType, err)
+	}
+
+	l.active = active
+	return active
+}
+
+// carpRe matches carp state reported by ifconfig, with vhid anywhere on the
+// same line: "carp: MASTER vhid 1 ..." on FreeBSD and
+// "carp: MASTER carpdev em0 vhid 1 ..." on OpenBSD.
+var carpRe = regexp.MustCompile(`carp: (\w+)\b[^\n]*?\bvhid (\d+)`)
+
+// checkCarp tells if carp state of interface is MASTER. If vhid is configured,
+// only state of this vhid is checked.
+func (l *Leader) checkCarp() (bool, error) {
+	out, err := exec.Command("/sbin/ifconfig", l.iface).Output()
+	if err != nil {
+		return false, err
+	}
+	return carpMaster(string(out), l.iface, l.vhid)
+}
+
+// carpMaster tells if all carp vhids, or only the given one, are MASTER in
+// ifconfig output of interface.
+func carpMaster(out string, iface string, vhid int) (bool, error) {
+	found := false
+	for _, match := range carpRe.FindAllStringSubmatch(out, -1) {
+		if vhid != 0 && match[2] != fmt.Sprintf("%d", vhid) {
+			continue
+		}
+		found = true
+		if match[1] != "MASTER" {
+			return false, nil
+		}
+	}
+	if found == false {
+		return false, fmt.Errorf("no carp on interface %s", iface)
+	}
+	return true, nil
+}
+
+// checkFile tells if file contains configured value, as written for example
+// by notify script of VRRP daemon.
+func (l *Leader) checkFile() (bool, error) {
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) == l.value, nil
+}
+
+// checkExec tells if command exits successfully.
+func (l *Leader) checkExec() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := exec.CommandContext(ctx, "/bin/sh", "-c", l.command).Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,68 @@
+package leader
+
+import (
+	"github.com/innogames/yacht/logger"
+	"testing"
+)
+
+const freeBSDIfconfig = `em0: flags=8843<UP,BROADCAST,RUNNING,SIMPLEX,MULTICAST> metric 0 mtu 1500
+	inet 192.0.2.2 netmask 0xffffff00 broadcast 192.0.2.255
+	inet 192.0.2.1 netmask 0xffffff00 broadcast 192.0.2.255 vhid 1
+	inet 192.0.2.3 netmask 0xffffff00 broadcast 192.0.2.255 vhid 2
+	carp: MASTER vhid 1 advbase 1 advskew 0
+	carp: BACKUP vhid 2 advbase 1 advskew 100
+`
+
+const openBSDIfconfig = `carp1: flags=8843<UP,BROADCAST,RUNNING,SIMPLEX,MULTICAST> mtu 1500
+	lladdr 00:00:5e:00:01:01
+	index 7 priority 15 llprio 3
+	carp: MASTER carpdev em0 vhid 1 advbase 1 advskew 0
+	groups: carp
+	status: master
+	inet 192.0.2.1 netmask 0xffffff00 broadcast 192.0.2.255
+`
+
+func TestCarpMaster(t *testing.T) {
+	for _, tc := range []struct {
+		out    string
+		vhid   int
+		active bool
+	}{
+		{freeBSDIfconfig, 1, true},
+		{freeBSDIfconfig, 2, false},
+		{freeBSDIfconfig, 0, false},
+		{openBSDIfconfig, 1, true},
+		{openBSDIfconfig, 0, true},
+	} {
+		active, err := carpMaster(tc.out, "em0", tc.vhid)
+		if err != nil || active != tc.active {
+			t.Errorf("vhid %d in:\n%sgot %v %v, want %v", tc.vhid, tc.out, active, err, tc.active)
+		}
+	}
+
+	if _, err := carpMaster("em0: flags=8843<UP> mtu 1500\n", "em0", 0); err == nil {
+		t.Error("missing carp not reported")
+	}
+	if _, err := carpMaster(freeBSDIfconfig, "em0", 3); err == nil {
+		t.Error("missing vhid not reported")
+	}
+}
+
+func TestInvalidConfigStaysBackup(t *testing.T) {
+	logger.InitLoggers(false)
+
+	for _, config := range []map[string]interface{}{
+		{},
+		{"type": "carp"},
+		{"type": "file"},
+		{"type": "vrrp", "path": "/tmp/state"},
+	} {
+		l := NewLeader(config)
+		if l == nil || l.IsActive() {
+			t.Errorf("invalid configuration %v is active", config)
+		}
+	}
+	if NewLeader(nil) != nil {
+		t.Error("missing configuration is not always active")
+	}
+}
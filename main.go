@@ -3,16 +3,25 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/innogames/yacht/backend"
+	"github.com/innogames/yacht/bgp"
+	"github.com/innogames/yacht/dnsserver"
+	"github.com/innogames/yacht/gossip"
 	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/leader"
 	"github.com/innogames/yacht/logger"
 	"github.com/innogames/yacht/pfctl"
+	"github.com/innogames/yacht/privsep"
+	"github.com/innogames/yacht/vip"
 )
 
 // AppState holds some variables which otherwise would be considered global.
@@ -20,6 +29,7 @@ type AppState struct {
 	//  commandline paramters
 	verbose  bool
 	noAction bool
+	pfSyntax string
 
 	// configuration
 	configFile string
@@ -27,9 +37,18 @@ type AppState struct {
 
 	// program operation
 	stopHealthChecks chan bool
+	logStatus        chan bool
 	programRunning   bool
+	gracefulShutdown int32 // set by signal handler, accessed atomically
 	wg               *sync.WaitGroup
 	pfctl            *pfctl.PFctl
+	breaker          *pfctl.Breaker
+	backends         map[string]backend.Backend
+	dnsServer        *dnsserver.Server
+	bgpSpeaker       *bgp.Speaker
+	vipManager       *vip.Manager
+	gossip           *gossip.Gossip
+	privsep          *privsep.Client
 
 	// LB Pools
 	lbPools []*lbpool.LBPool
@@ -38,15 +57,22 @@ type AppState struct {
 func (appState *AppState) initFlags() {
 	flag.StringVar(&appState.configFile, "c", "/etc/iglb/iglb.json", "Location of confguration file")
 	flag.BoolVar(&appState.verbose, "v", false, "Be verbose, e.g. show every healhcheck")
-	flag.BoolVar(&appState.noAction, "n", false, "Do not perform any pfctl actions")
+	flag.BoolVar(&appState.noAction, "n", false, "Do not perform any pfctl actions, only log them")
+	flag.StringVar(&appState.pfSyntax, "pf-syntax", "", "Syntax of rules printed by gen-pf, freebsd or openbsd, default is of this system")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [gen-pf]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  gen-pf\tprint pf.conf fragment for configured LB Pools and exit\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 }
 
 func (appState *AppState) initSignals() {
 	c := make(chan os.Signal, 1)
 	appState.stopHealthChecks = make(chan bool)
+	appState.logStatus = make(chan bool, 1)
 
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 
 	go func() {
 		for {
@@ -57,9 +83,20 @@ func (appState *AppState) initSignals() {
 				appState.stopHealthChecks <- true
 			case syscall.SIGTERM:
 				appState.programRunning = false
+				atomic.StoreInt32(&appState.gracefulShutdown, 1)
 				appState.stopHealthChecks <- true
 			case syscall.SIGHUP:
 				appState.stopHealthChecks <- true
+			case syscall.SIGUSR1:
+				// Operator acknowledges tripped removal breaker.
+				appState.breaker.Acknowledge()
+			case syscall.SIGUSR2:
+				// Operator wants to see status of all LB Pools. They are
+				// owned by mainLoop, which logs them.
+				select {
+				case appState.logStatus <- true:
+				default:
+				}
 			}
 		}
 	}()
@@ -79,10 +116,23 @@ func (appState *AppState) loadConfig() {
 	json.Unmarshal(file, appState.config)
 }
 
+// closeBackends releases resources held by backends.
+func (appState *AppState) closeBackends() {
+	for _, b := range appState.backends {
+		if closer, ok := b.(backend.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
 // runLBPools materializes LB Pools from configuration in AppState.
 // Each of LB Pools will then run as a goroutine.
 func (appState *AppState) runLBPools() {
 
+	// LB Pools of previous configuration are stopped already. Nothing must
+	// use them, even if the new configuration is refused.
+	appState.lbPools = nil
+
 	// Ensure that configuration was loaded correctly
 	if appState.config == nil {
 		logger.Error.Printf("No LB Pools found in config!")
@@ -90,8 +140,36 @@ func (appState *AppState) runLBPools() {
 		return
 	}
 
+	// Privileged helper must accept tables of the new configuration.
+	if appState.privsep != nil {
+		if err := privsep.CheckConfig(*appState.config); err != nil {
+			logger.Error.Printf("Invalid configuration: %v", err)
+			time.Sleep(1 * time.Second)
+			return
+		}
+		if err := appState.privsep.Reload(); err != nil {
+			logger.Error.Printf("%v", err)
+		}
+	}
+
+	// Create backends to which LB Pools are applied. Old ones must release
+	// their resources first.
+	appState.closeBackends()
+	backendsConfig, _ := (*appState.config)["backends"].(map[string]interface{})
+	appState.backends = backend.NewBackends(backendsConfig, appState.noAction)
+
+	// Configure global removal breaker, it is disabled if not configured.
+	breakerConfig, _ := (*appState.config)["removal_breaker"].(map[string]interface{})
+	appState.breaker.Configure(breakerConfig)
+
 	logger.Debug.Printf("Creating and starting LB Pools")
 	if lbPools, ok := (*appState.config)["lbpools"].(map[string]interface{}); ok {
+		// Dependencies between LB Pools must be correct before anything is started.
+		if err := lbpool.CheckDependencies(lbPools); err != nil {
+			logger.Error.Printf("Invalid LB Pools configuration: %v", err)
+			return
+		}
+
 		for poolName, poolConfig := range lbPools {
 			poolConfigMap := poolConfig.(map[string]interface{})
 			// For each LB Pool found in configuration file try to spawn a new
@@ -99,17 +177,132 @@ func (appState *AppState) runLBPools() {
 			// LB Pool has no configured IP address for given protocol.
 			if lbPool := lbpool.NewLBPool("4", poolName, poolConfigMap); lbPool != nil {
 				appState.lbPools = append(appState.lbPools, lbPool)
-				go lbPool.Run(appState.wg)
 			}
 			if lbPool := lbpool.NewLBPool("6", poolName, poolConfigMap); lbPool != nil {
 				appState.lbPools = append(appState.lbPools, lbPool)
-				go lbPool.Run(appState.wg)
 			}
 		}
+
+		// LB Pools are started only after all of them are created and linked.
+		lbpool.LinkDependencies(appState.lbPools)
+		lbpool.LinkProtocols(appState.lbPools)
+
+		// Results of other instances are kept across reloads, only LB Nodes
+		// and configuration change.
+		gossipConfig, _ := (*appState.config)["gossip"].(map[string]interface{})
+		if appState.gossip != nil && appState.gossip.Reconfigure(gossipConfig) == false {
+			appState.gossip.Stop()
+			appState.gossip = nil
+		}
+		if appState.gossip == nil {
+			appState.gossip = gossip.NewGossip(gossipConfig, appState.noAction)
+		}
+		if appState.gossip != nil {
+			appState.gossip.Reset()
+			lbpool.UseQuorum(appState.lbPools, appState.gossip)
+		}
+
+		// DNS server must subscribe to LB Pools before they run. Dry run
+		// must not answer real clients.
+		if appState.noAction == false {
+			dnsConfig, _ := (*appState.config)["dns"].(map[string]interface{})
+			appState.dnsServer = dnsserver.NewServer(dnsConfig, appState.lbPools)
+		}
+
+		// BGP sessions survive reloads, only sessions of changed peers are
+		// restarted. Dry run must not announce anything.
+		bgpConfig, _ := (*appState.config)["bgp"].(map[string]interface{})
+		if appState.bgpSpeaker != nil && bgpConfig == nil {
+			appState.bgpSpeaker.Shutdown(false)
+			appState.bgpSpeaker = nil
+		} else if appState.bgpSpeaker != nil {
+			appState.bgpSpeaker.Reconfigure(bgpConfig)
+		} else if appState.noAction == false {
+			appState.bgpSpeaker = bgp.NewSpeaker(bgpConfig)
+		}
+		if appState.bgpSpeaker != nil {
+			appState.bgpSpeaker.Follow(appState.lbPools)
+		}
+
+		// Owned addresses on local interfaces survive reloads too. They are
+		// removed together with configuration of Manager.
+		vipConfig, _ := (*appState.config)["vip"].(map[string]interface{})
+		if appState.vipManager != nil && vipConfig == nil {
+			appState.vipManager.Shutdown(true)
+			appState.vipManager = nil
+		} else if appState.vipManager != nil {
+			appState.vipManager.Reconfigure(vipConfig)
+		} else if appState.noAction == false {
+			appState.vipManager = vip.NewManager(vipConfig)
+		}
+		for _, lbPool := range appState.lbPools {
+			if appState.vipManager == nil && appState.noAction == false && lbPool.GetVIPInterface() != "" {
+				logger.Warning.Printf(lbPool.GetLogPrefix()+"vip_interface: %s ignored, vip is not configured", lbPool.GetVIPInterface())
+			}
+		}
+		if appState.vipManager != nil {
+			appState.vipManager.Follow(appState.lbPools)
+		}
+
+		for _, lbPool := range appState.lbPools {
+			go lbPool.Run(appState.wg)
+		}
 	}
 	logger.Debug.Printf("All LB Pools started")
 }
 
+// startPrivsep starts privileged helper managing pf tables and drops privileges
+// of this process, if configured. It must be done before any healthcheck runs.
+func (appState *AppState) startPrivsep() {
+	appState.loadConfig()
+	privsepConfig, _ := (*appState.config)["privsep"].(map[string]interface{})
+	userName, _ := privsepConfig["user"].(string)
+	if userName == "" {
+		return
+	}
+	if err := privsep.CheckConfig(*appState.config); err != nil {
+		logger.Error.Printf("Unable to start privilege separation: %v", err)
+		os.Exit(1)
+	}
+
+	client, err := privsep.Start(appState.configFile, userName)
+	if err != nil {
+		logger.Error.Printf("Unable to start privilege separation: %v", err)
+		os.Exit(1)
+	}
+	appState.privsep = client
+	backend.SetPFctlExecutor(client)
+}
+
+// genPF prints pf.conf fragment with tables and rules of all LB Pools
+// found in configuration. LB Pools are created but never run.
+func (appState *AppState) genPF() int {
+	appState.loadConfig()
+	lbPoolsConfig, ok := (*appState.config)["lbpools"].(map[string]interface{})
+	if !ok {
+		logger.Error.Printf("No LB Pools found in config!")
+		return 1
+	}
+
+	var lbPools []*lbpool.LBPool
+	for poolName, poolConfig := range lbPoolsConfig {
+		poolConfigMap := poolConfig.(map[string]interface{})
+		for _, proto := range []string{"4", "6"} {
+			if lbPool := lbpool.NewLBPool(proto, poolName, poolConfigMap); lbPool != nil {
+				lbPools = append(lbPools, lbPool)
+			}
+		}
+	}
+
+	pfConf, err := backend.PFConf(lbPools, appState.pfSyntax)
+	if err != nil {
+		logger.Error.Printf("Unable to generate pf.conf: %v", err)
+		return 1
+	}
+	fmt.Print(pfConf)
+	return 0
+}
+
 // mainLoop of the whole program. It loads configuration, creates all LB Pools,
 // runs them and awaits them to finish working. After that loads the config again
 // and repeats the whole process.
@@ -127,15 +320,29 @@ func (appState *AppState) mainLoop() {
 		// Load configuration and run loaded LB Pools.
 		appState.loadConfig()
 		appState.runLBPools()
-		appState.pfctl = pfctl.NewPFctl(appState.wg, appState.lbPools)
+		coalesce, _ := (*appState.config)["sync_coalesce"].(float64)
+		leaderConfig, _ := (*appState.config)["leader"].(map[string]interface{})
+		appState.pfctl = pfctl.NewPFctl(appState.wg, appState.lbPools, appState.backends, appState.breaker, time.Duration(coalesce*float64(time.Second)), appState.noAction, leader.NewLeader(leaderConfig))
 
 		// Wait for a channel message which will terminate all running checks.
-		select {
-		case <-appState.stopHealthChecks:
-			for _, lbPool := range appState.lbPools {
-				lbPool.Stop()
+		running := true
+		for running {
+			select {
+			case <-appState.logStatus:
+				for _, lbPool := range appState.lbPools {
+					lbPool.LogStatus()
+				}
+			case <-appState.stopHealthChecks:
+				for _, lbPool := range appState.lbPools {
+					lbPool.Stop()
+				}
+				appState.pfctl.Stop()
+				if appState.dnsServer != nil {
+					appState.dnsServer.Stop()
+					appState.dnsServer = nil
+				}
+				running = false
 			}
-			appState.pfctl.Stop()
 		}
 		// Wait for healthchecks to be really finished.
 		// This means: wait for wg counter to reach 0.
@@ -149,10 +356,39 @@ func main() {
 	appState.initFlags()
 	logger.InitLoggers(appState.verbose)
 
+	switch flag.Arg(0) {
+	case "":
+	case "gen-pf":
+		// Standard output is reserved for generated configuration.
+		logger.Info.SetOutput(os.Stderr)
+		os.Exit(appState.genPF())
+	case "privsep-helper":
+		os.Exit(privsep.RunHelper(appState.configFile))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	logger.Info.Println("Yet Another Checking Health Tool starting")
+	if appState.noAction {
+		logger.Info.Println("Dry run, no changes will be applied")
+	}
 
+	appState.startPrivsep()
+	appState.breaker = pfctl.NewBreaker()
 	appState.initSignals()
 	appState.mainLoop()
+	appState.closeBackends()
+
+	if appState.bgpSpeaker != nil {
+		appState.bgpSpeaker.Shutdown(atomic.LoadInt32(&appState.gracefulShutdown) == 1)
+	}
+	if appState.vipManager != nil {
+		appState.vipManager.Shutdown(false)
+	}
+	if appState.gossip != nil {
+		appState.gossip.Stop()
+	}
 
 	logger.Info.Println("Finished, good bye!")
 }
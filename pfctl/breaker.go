@@ -0,0 +1,167 @@
+package pfctl
+
+import (
+	"github.com/innogames/yacht/logger"
+	"sync"
+	"time"
+)
+
+// Breaker refuses to remove too many nodes across all LB Pools at once.
+// Once tripped it freezes all pf changes until an operator acknowledges it.
+// It outlives configuration reloads so that a reload does not silently unfreeze pf.
+type Breaker struct {
+	sync.Mutex
+
+	// Configuration
+	maxPercent float64
+	window     time.Duration
+
+	// Operation
+	removals     []breakerRemoval
+	tripped      bool
+	acknowledged bool
+	notifyChan   chan bool
+}
+
+type breakerRemoval struct {
+	when  time.Time
+	count int
+}
+
+// NewBreaker creates new, not configured and thus disabled Breaker.
+func NewBreaker() *Breaker {
+	return new(Breaker)
+}
+
+// Configure reads Breaker settings from JSON configuration.
+// Breaker is disabled if max_percent is not configured.
+func (br *Breaker) Configure(json map[string]interface{}) {
+	defer br.Unlock()
+	br.Lock()
+
+	br.maxPercent = 0
+	br.window = 60 * time.Second
+
+	if maxPercent, ok := json["max_percent"].(float64); ok && maxPercent > 0 {
+		br.maxPercent = maxPercent
+	}
+	if window, ok := json["window"].(float64); ok && window > 0 {
+		br.window = time.Duration(window) * time.Second
+	}
+
+	if br.maxPercent > 0 {
+		logger.Info.Printf("breaker: max %.0f%% of nodes in %s configured", br.maxPercent, br.window)
+	}
+}
+
+// setNotify sets channel which is told when the Breaker is acknowledged,
+// so that frozen changes are applied right away.
+func (br *Breaker) setNotify(ch chan bool) {
+	defer br.Unlock()
+	br.Lock()
+	br.notifyChan = ch
+}
+
+// allow checks if given amount of nodes can be removed in addition to pending
+// ones, which were allowed in the same run but are not applied yet. allNodes
+// is the count of nodes in all LB Pools. Run acknowledged by an operator is
+// let through. Removals are remembered only once recorded.
+func (br *Breaker) allow(count int, pending int, allNodes int, acknowledged bool) bool {
+	defer br.Unlock()
+	br.Lock()
+
+	if br.tripped {
+		return false
+	}
+	if br.maxPercent == 0 || count == 0 || allNodes == 0 || acknowledged {
+		return true
+	}
+
+	removed := br.removed(count+pending, time.Now())
+	if float64(removed)*100/float64(allNodes) > br.maxPercent {
+		br.tripped = true
+		logger.Error.Printf("breaker: removing %d of %d nodes in %s exceeds %.0f%%, freezing pf changes until acknowledged", removed, allNodes, br.window, br.maxPercent)
+		return false
+	}
+	return true
+}
+
+// record remembers given amount of nodes removed successfully.
+func (br *Breaker) record(count int) {
+	defer br.Unlock()
+	br.Lock()
+
+	if br.maxPercent == 0 || count == 0 {
+		return
+	}
+	now := time.Now()
+	var removals []breakerRemoval
+	for _, removal := range br.removals {
+		if now.Sub(removal.when) < br.window {
+			removals = append(removals, removal)
+		}
+	}
+	br.removals = append(removals, breakerRemoval{now, count})
+}
+
+// removed returns count of nodes removed within window including given ones.
+// Breaker must be already locked.
+func (br *Breaker) removed(count int, now time.Time) int {
+	removed := count
+	for _, removal := range br.removals {
+		if now.Sub(removal.when) < br.window {
+			removed += removal.count
+		}
+	}
+	return removed
+}
+
+// wouldAllow tells if allow would let given amount of nodes be removed,
+// without tripping the Breaker. It is used in dry run.
+func (br *Breaker) wouldAllow(count int, allNodes int) bool {
+	defer br.Unlock()
+	br.Lock()
+
+	if br.tripped {
+		return false
+	}
+	if br.maxPercent == 0 || count == 0 || allNodes == 0 || br.acknowledged {
+		return true
+	}
+	return float64(br.removed(count, time.Now()))*100/float64(allNodes) <= br.maxPercent
+}
+
+// takeAcknowledged tells if an operator has acknowledged the Breaker since
+// the last run. Removals of the whole run calling it are then let through.
+func (br *Breaker) takeAcknowledged() bool {
+	defer br.Unlock()
+	br.Lock()
+	acknowledged := br.acknowledged
+	br.acknowledged = false
+	return acknowledged
+}
+
+// Tripped tells if pf changes are frozen.
+func (br *Breaker) Tripped() bool {
+	defer br.Unlock()
+	br.Lock()
+	return br.tripped
+}
+
+// Acknowledge resets the Breaker, it is called by an operator via the control interface.
+// Removals of the next run across all LB Pools are let through even if they
+// alone exceed the limit.
+func (br *Breaker) Acknowledge() {
+	defer br.Unlock()
+	br.Lock()
+	if br.tripped {
+		logger.Info.Printf("breaker: acknowledged, unfreezing pf changes")
+		br.acknowledged = true
+		select {
+		case br.notifyChan <- true:
+		default:
+		}
+	}
+	br.tripped = false
+	br.removals = nil
+}
@@ -0,0 +1,109 @@
+package pfctl
+
+import (
+	"github.com/innogames/yacht/logger"
+	"testing"
+)
+
+func TestBreakerAcknowledge(t *testing.T) {
+	logger.InitLoggers(false)
+
+	br := NewBreaker()
+	br.Configure(map[string]interface{}{"max_percent": 20.0})
+
+	if br.allow(1, 0, 10, false) == false {
+		t.Fatal("removal within limit refused")
+	}
+	br.record(1)
+	if br.allow(5, 0, 10, false) {
+		t.Fatal("removal over limit allowed")
+	}
+	if br.Tripped() == false {
+		t.Fatal("breaker not tripped")
+	}
+	if br.allow(1, 0, 10, false) {
+		t.Fatal("tripped breaker allowed removal")
+	}
+
+	br.Acknowledge()
+	if br.Tripped() {
+		t.Fatal("breaker still tripped after acknowledge")
+	}
+
+	// Acknowledgement applies to all LB Pools of the next run.
+	acknowledged := br.takeAcknowledged()
+	if acknowledged == false {
+		t.Fatal("acknowledgement not taken by run")
+	}
+	for pool := 0; pool < 3; pool++ {
+		if br.allow(3, pool*3, 10, acknowledged) == false {
+			t.Fatalf("removal of pool %d in acknowledged run refused", pool)
+		}
+		br.record(3)
+	}
+
+	// And to that run only.
+	if br.takeAcknowledged() {
+		t.Fatal("acknowledgement taken twice")
+	}
+	if br.allow(1, 0, 10, false) {
+		t.Fatal("removal over limit in the next run allowed")
+	}
+}
+
+func TestBreakerPending(t *testing.T) {
+	logger.InitLoggers(false)
+
+	br := NewBreaker()
+	br.Configure(map[string]interface{}{"max_percent": 20.0})
+
+	// Removals allowed in a run count together before they are applied.
+	if br.allow(2, 0, 10, false) == false {
+		t.Fatal("removal within limit refused")
+	}
+	if br.allow(1, 2, 10, false) {
+		t.Fatal("removal over limit together with pending ones allowed")
+	}
+}
+
+func TestBreakerFailedRemovals(t *testing.T) {
+	logger.InitLoggers(false)
+
+	br := NewBreaker()
+	br.Configure(map[string]interface{}{"max_percent": 20.0})
+
+	// Failed syncs are retried, removals not recorded must not add up.
+	for retry := 0; retry < 5; retry++ {
+		if br.allow(2, 0, 10, false) == false {
+			t.Fatalf("retry %d of failed removal refused", retry)
+		}
+	}
+	br.record(2)
+	if br.allow(1, 0, 10, false) {
+		t.Fatal("removal over limit together with applied ones allowed")
+	}
+}
+
+func TestBreakerWouldAllow(t *testing.T) {
+	logger.InitLoggers(false)
+
+	br := NewBreaker()
+	br.Configure(map[string]interface{}{"max_percent": 20.0})
+
+	if br.wouldAllow(2, 10) == false {
+		t.Fatal("removal within limit refused")
+	}
+	if br.wouldAllow(5, 10) {
+		t.Fatal("removal over limit allowed")
+	}
+	if br.Tripped() {
+		t.Fatal("breaker tripped by read-only check")
+	}
+	if br.allow(2, 0, 10, false) == false {
+		t.Fatal("removal within limit refused after read-only checks")
+	}
+	br.record(2)
+	if br.wouldAllow(1, 10) {
+		t.Fatal("removal over limit together with previous one allowed")
+	}
+}
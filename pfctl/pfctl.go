@@ -1,55 +1,314 @@
 package pfctl
 
 import (
+	"github.com/innogames/yacht/backend"
 	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/leader"
 	"github.com/innogames/yacht/logger"
 	"sync"
 	"time"
 )
 
-// PFctl handles operations on pf
+// PFctl applies wanted nodes of LB Pools to their backends, pf by default.
+// Changes are applied as soon as LB Pools announce them.
 type PFctl struct {
 	lbPools  []*lbpool.LBPool
+	backends map[string]backend.Backend
 	wg       *sync.WaitGroup
 	active   bool
 	stopChan chan bool
+	changes  chan bool
+	coalesce time.Duration
+	dryRun   bool
+	breaker  *Breaker
+	leader   *leader.Leader
 }
 
-// NewPFctl creates new PFctl object
-func NewPFctl(wg *sync.WaitGroup, lbPools []*lbpool.LBPool) *PFctl {
+// NewPFctl creates new PFctl object. Bursts of changes arriving within
+// coalesce window are applied at once. In dry run backends are only read
+// and changes which would be applied are logged. With leader configured changes
+// are applied only while this instance is the active one.
+func NewPFctl(wg *sync.WaitGroup, lbPools []*lbpool.LBPool, backends map[string]backend.Backend, breaker *Breaker, coalesce time.Duration, dryRun bool, leader *leader.Leader) *PFctl {
 	pfctl := new(PFctl)
 	pfctl.wg = wg
+	pfctl.breaker = breaker
 	pfctl.stopChan = make(chan bool)
+	pfctl.changes = make(chan bool, 1)
+	pfctl.coalesce = coalesce
+	pfctl.dryRun = dryRun
+	pfctl.leader = leader
 	pfctl.lbPools = lbPools
+	pfctl.backends = backends
+
+	for _, lbPool := range lbPools {
+		if _, ok := backends[lbPool.GetBackend()]; !ok {
+			logger.Error.Printf(lbPool.GetLogPrefix()+"unknown backend %s", lbPool.GetBackend())
+		}
+		lbPool.SubscribeChan(pfctl.changes)
+	}
+	breaker.setNotify(pfctl.changes)
 
 	go pfctl.run()
 
 	return pfctl
 }
 
+// prepare gives backends generating their own configuration their LB Pools.
+func (pfctl *PFctl) prepare() {
+	for name, b := range pfctl.backends {
+		if preparer, ok := b.(backend.Preparer); ok {
+			var backendPools []*lbpool.LBPool
+			for _, lbPool := range pfctl.lbPools {
+				if lbPool.GetBackend() == name {
+					backendPools = append(backendPools, lbPool)
+				}
+			}
+			if err := preparer.Prepare(backendPools); err != nil {
+				logger.Error.Printf("backend: %s %v", name, err)
+			}
+		}
+	}
+}
+
+// checkActive tells if changes should be applied. When this instance becomes
+// active, backends are prepared and all LB Pools are reconciled right away,
+// as changes done meanwhile by the other instance are unknown.
+func (pfctl *PFctl) checkActive() bool {
+	active := pfctl.leader == nil || pfctl.leader.IsActive()
+	if active && pfctl.active == false {
+		if pfctl.leader != nil {
+			logger.Info.Printf("leader: became active, reconciling all LB Pools")
+		}
+		if pfctl.dryRun == false {
+			pfctl.prepare()
+		}
+		for _, lbPool := range pfctl.lbPools {
+			lbPool.MarkChanged()
+		}
+	}
+	if active == false && pfctl.active {
+		logger.Info.Printf("leader: became backup, not applying changes")
+	}
+	pfctl.active = active
+	return active
+}
+
+// tick lets backends perform their periodic work.
+func (pfctl *PFctl) tick() {
+	for _, b := range pfctl.backends {
+		if ticker, ok := b.(backend.Ticker); ok {
+			ticker.Tick()
+		}
+	}
+}
+
+// do applies pending changes of all LB Pools.
 func (pfctl *PFctl) do() {
+	// Backup instance leaves all changes pending in LB Pools.
+	if pfctl.checkActive() == false {
+		return
+	}
+
+	// Frozen Breaker leaves all changes pending in LB Pools.
+	if pfctl.breaker.Tripped() {
+		return
+	}
+
+	var allNodes int
 	for _, lbPool := range pfctl.lbPools {
+		allNodes += lbPool.NodeCount()
+	}
+
+	if pfctl.dryRun {
+		for name, b := range pfctl.backends {
+			pfctl.doBackendDryRun(name, b, allNodes)
+		}
+		return
+	}
+
+	// Acknowledgement of Breaker covers removals of all LB Pools in this run.
+	acknowledged := pfctl.breaker.takeAcknowledged()
+	for name, b := range pfctl.backends {
+		pfctl.doBackend(name, b, allNodes, acknowledged)
+	}
+}
+
+// doBackend applies changes of all LB Pools using given backend. Transactional
+// backends get all changes at once. If any of them fails, all changes are rolled
+// back and LB Pools are left pending. Failed LB Pools are retried with backoff.
+// Breaker remembers only removals which were applied.
+func (pfctl *PFctl) doBackend(name string, b backend.Backend, allNodes int, acknowledged bool) {
+	transaction, _ := b.(backend.Transactional)
+	var applied []*lbpool.LBPool
+	removals := map[*lbpool.LBPool]int{}
+	pending := 0
+
+	for _, lbPool := range pfctl.lbPools {
+		if lbPool.GetBackend() != name {
+			continue
+		}
 		poolName, poolNodes, logPrefix := lbPool.GetWantedNodes()
-		if poolNodes != nil {
-			err := pfctlSyncTable(poolName, poolNodes)
-			if err != nil {
+		if poolNodes == nil {
+			continue
+		}
+
+		curSet, err := b.GetSet(lbPool, poolName)
+		if err != nil {
+			logger.Error.Printf(logPrefix + err.Error())
+			lbPool.SyncFailed()
+			continue
+		}
+		_, delSet := backend.Diff(curSet, poolNodes)
+		if pfctl.breaker.allow(len(delSet), pending, allNodes, acknowledged) == false {
+			lbPool.MarkChanged()
+			continue
+		}
+
+		if transaction != nil && len(applied) == 0 {
+			if err := transaction.Begin(); err != nil {
 				logger.Error.Printf(logPrefix + err.Error())
+				lbPool.SyncFailed()
+				continue
 			}
 		}
+
+		if err := b.SyncSet(lbPool, poolName, curSet, poolNodes); err != nil {
+			logger.Error.Printf(logPrefix + err.Error())
+			lbPool.SyncFailed()
+			if transaction != nil {
+				transaction.Rollback()
+				for _, lbPool := range applied {
+					lbPool.MarkChanged()
+				}
+				applied = nil
+				removals = map[*lbpool.LBPool]int{}
+				pending = 0
+			}
+			continue
+		}
+		if transaction == nil {
+			pfctl.breaker.record(len(delSet))
+			lbPool.SyncSucceeded()
+			continue
+		}
+		applied = append(applied, lbPool)
+		removals[lbPool] = len(delSet)
+		pending += len(delSet)
+	}
+
+	if transaction != nil && len(applied) > 0 {
+		// Failed commit has applied nothing, unless it tells which LB Pools failed.
+		failed := map[*lbpool.LBPool]bool{}
+		if err := transaction.Commit(); err != nil {
+			logger.Error.Printf("backend: %s %s", name, err.Error())
+			if commitErr, ok := err.(backend.CommitError); ok {
+				for _, lbPool := range commitErr.Failed {
+					failed[lbPool] = true
+				}
+			} else {
+				for _, lbPool := range applied {
+					failed[lbPool] = true
+				}
+			}
+		}
+		for _, lbPool := range applied {
+			if failed[lbPool] {
+				lbPool.SyncFailed()
+				continue
+			}
+			pfctl.breaker.record(removals[lbPool])
+			lbPool.SyncSucceeded()
+		}
+	}
+}
+
+// doBackendDryRun logs changes of all LB Pools using given backend instead
+// of applying them.
+func (pfctl *PFctl) doBackendDryRun(name string, b backend.Backend, allNodes int) {
+	removed := 0
+	for _, lbPool := range pfctl.lbPools {
+		if lbPool.GetBackend() != name {
+			continue
+		}
+		poolName, poolNodes, logPrefix := lbPool.GetWantedNodes()
+		if poolNodes == nil {
+			continue
+		}
+
+		curSet, err := b.GetSet(lbPool, poolName)
+		if err != nil {
+			logger.Error.Printf(logPrefix + err.Error())
+			lbPool.SyncFailed()
+			continue
+		}
+		addSet, delSet := backend.Diff(curSet, poolNodes)
+		if len(addSet) > 0 || len(delSet) > 0 {
+			logger.Info.Printf(logPrefix+"dry run: backend: %s set: %s would add: %s would remove: %s", name, poolName, addSet, delSet)
+		}
+		// Removals of all LB Pools in this run are checked together, as they would be applied.
+		removed += len(delSet)
+		if pfctl.breaker.wouldAllow(removed, allNodes) == false {
+			logger.Warning.Printf(logPrefix+"dry run: backend: %s set: %s breaker would refuse removing %d nodes", name, poolName, removed)
+		}
+		lbPool.SyncSucceeded()
 	}
 }
 
+// run applies changes whenever LB Pools announce them. LB Pools announce also
+// retries of failed syncs and periodic reconciliation, changes frozen by
+// Breaker are applied once it is acknowledged. Leader is checked every
+// second. Backends needing periodic work are ticked every 100ms.
 func (pfctl *PFctl) run() {
 	defer pfctl.wg.Done()
 	pfctl.wg.Add(1)
 
+	// Ticking backends could change them, which is not wanted in dry run.
+	var tickChan <-chan time.Time
+	for _, b := range pfctl.backends {
+		if pfctl.dryRun {
+			break
+		}
+		if _, ok := b.(backend.Ticker); ok {
+			ticker := time.NewTicker(time.Millisecond * time.Duration(100))
+			defer ticker.Stop()
+			tickChan = ticker.C
+			break
+		}
+	}
+	// Backup instance must notice becoming active.
+	var leaderChan <-chan time.Time
+	if pfctl.leader != nil {
+		leaderTicker := time.NewTicker(time.Second)
+		defer leaderTicker.Stop()
+		leaderChan = leaderTicker.C
+	}
+	// Changes arriving until coalesce timer fires are applied together.
+	var coalesceChan <-chan time.Time
+
+	pfctl.do()
 	for {
-		pfctl.do()
 		select {
 		case <-pfctl.stopChan:
 			logger.Debug.Printf("received stopchan")
 			return
-		case <-time.After(time.Millisecond * time.Duration(100)):
+		case <-pfctl.changes:
+			if pfctl.coalesce == 0 {
+				pfctl.do()
+			} else if coalesceChan == nil {
+				coalesceChan = time.After(pfctl.coalesce)
+			}
+		case <-coalesceChan:
+			coalesceChan = nil
+			pfctl.do()
+		case <-leaderChan:
+			wasActive := pfctl.active
+			if pfctl.checkActive() && wasActive == false {
+				pfctl.do()
+			}
+		case <-tickChan:
+			if pfctl.active {
+				pfctl.tick()
+			}
 		}
 	}
 }
@@ -0,0 +1,225 @@
+package privsep
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/innogames/yacht/backend"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// tableKey identifies pf table in anchor.
+type tableKey struct {
+	anchor string
+	table  string
+}
+
+// allowedTable is a pf table of LB Pool found in configuration, with
+// addresses of its LB Nodes.
+type allowedTable struct {
+	nodes map[string]bool
+}
+
+// killKey identifies LB Node of given protocol whose states can be killed.
+// Kills are run with pfctl of pf backend of its LB Pool.
+type killKey struct {
+	proto string
+	node  string
+}
+
+// helper is the privileged process. It performs only operations on tables
+// of LB Pools using pf backends, with addresses of their LB Nodes.
+type helper struct {
+	configFile string
+	tables     map[tableKey]*allowedTable
+	kills      map[killKey]string
+	pfctl      map[string]backend.PFctlExecutor
+}
+
+// RunHelper is the main loop of privileged helper. It serves requests coming
+// over file descriptor 3 until unprivileged process closes it.
+func RunHelper(configFile string) int {
+	// Helper terminates together with unprivileged process, not on signals.
+	signal.Ignore(syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	conn, err := net.FileConn(os.NewFile(3, "privsep"))
+	if err != nil {
+		logger.Error.Printf("privsep: helper: %v", err)
+		return 1
+	}
+	defer conn.Close()
+
+	h := &helper{configFile: configFile}
+	if err := h.reload(); err != nil {
+		logger.Error.Printf("privsep: helper: %v", err)
+	}
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+	for {
+		var req Request
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				logger.Error.Printf("privsep: helper: %v", err)
+			}
+			return 0
+		}
+		var resp Response
+		if err := h.handle(req, &resp); err != nil {
+			logger.Error.Printf("privsep: helper: op: %s %v", req.Op, err)
+			resp.Error = err.Error()
+		}
+		if err := enc.Encode(resp); err != nil {
+			logger.Error.Printf("privsep: helper: %v", err)
+			return 1
+		}
+	}
+}
+
+// reload reads tables of all LB Pools using pf backends from configuration.
+func (h *helper) reload() error {
+	file, err := ioutil.ReadFile(h.configFile)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(file, &config); err != nil {
+		return err
+	}
+
+	// Anchors of pf backends, the same default as in backend.NewBackends.
+	// Each anchor is changed with pfctl of its backend.
+	anchors := map[string]string{}
+	pfctl := map[string]backend.PFctlExecutor{}
+	backendsConfig, _ := config["backends"].(map[string]interface{})
+	if len(backendsConfig) == 0 {
+		anchors[lbpool.DefaultBackend] = ""
+		pfctl[""] = backend.LocalPFctl("")
+	}
+	for name, backendConfig := range backendsConfig {
+		backendConfigMap, _ := backendConfig.(map[string]interface{})
+		if backendType, _ := backendConfigMap["type"].(string); backendType == "pf" {
+			anchor, _ := backendConfigMap["anchor"].(string)
+			path, _ := backendConfigMap["pfctl"].(string)
+			anchors[name] = anchor
+			pfctl[anchor] = backend.LocalPFctl(path)
+		}
+	}
+
+	tables := map[tableKey]*allowedTable{}
+	kills := map[killKey]string{}
+	lbPools, _ := config["lbpools"].(map[string]interface{})
+	for _, poolConfig := range lbPools {
+		poolConfigMap, _ := poolConfig.(map[string]interface{})
+		backendName, ok := poolConfigMap["backend"].(string)
+		if !ok {
+			backendName = lbpool.DefaultBackend
+		}
+		anchor, ok := anchors[backendName]
+		if !ok {
+			continue
+		}
+		pfName, _ := poolConfigMap["pf_name"].(string)
+		nodesConfig, _ := poolConfigMap["nodes"].(map[string]interface{})
+		for _, proto := range []string{"4", "6"} {
+			if _, ok := poolConfigMap["ip"+proto].(string); !ok || pfName == "" {
+				continue
+			}
+			table := &allowedTable{nodes: map[string]bool{}}
+			for _, nodeConfig := range nodesConfig {
+				nodeConfigMap, _ := nodeConfig.(map[string]interface{})
+				nodeIP, _ := nodeConfigMap["ip"+proto].(string)
+				if ipAddress := net.ParseIP(nodeIP); ipAddress != nil {
+					table.nodes[ipAddress.String()] = true
+					kills[killKey{proto, ipAddress.String()}] = anchor
+				}
+			}
+			tables[tableKey{anchor, pfName + "_" + proto}] = table
+		}
+	}
+
+	h.tables = tables
+	h.kills = kills
+	h.pfctl = pfctl
+	logger.Info.Printf("privsep: helper: %d tables allowed", len(tables))
+	return nil
+}
+
+// checkTable verifies that table is one of allowed tables and that all
+// addresses belong to its LB Nodes.
+func (h *helper) checkTable(anchor string, table string, addresses []string) ([]net.IP, error) {
+	allowed, ok := h.tables[tableKey{anchor, table}]
+	if !ok {
+		return nil, fmt.Errorf("table %s in anchor %q not allowed", table, anchor)
+	}
+	ret := []net.IP{}
+	for _, address := range addresses {
+		ipAddress := net.ParseIP(address)
+		if ipAddress == nil || allowed.nodes[ipAddress.String()] == false {
+			return nil, fmt.Errorf("address %s not allowed in table %s", address, table)
+		}
+		ret = append(ret, ipAddress)
+	}
+	return ret, nil
+}
+
+// handle validates and performs a single request.
+func (h *helper) handle(req Request, resp *Response) error {
+	switch req.Op {
+	case "reload":
+		return h.reload()
+	case "show":
+		if _, err := h.checkTable(req.Anchor, req.Table, nil); err != nil {
+			return err
+		}
+		entries, err := h.pfctl[req.Anchor].ShowTable(req.Anchor, req.Table)
+		resp.Entries = entries
+		return err
+	case "replace":
+		ipAddresses, err := h.checkTable(req.Anchor, req.Table, req.Addresses)
+		if err != nil {
+			return err
+		}
+		return h.pfctl[req.Anchor].ReplaceTable(req.Anchor, req.Table, ipAddresses)
+	case "load":
+		if _, ok := h.pfctl[req.Anchor]; !ok {
+			return fmt.Errorf("anchor %q not allowed", req.Anchor)
+		}
+		tables := map[string][]net.IP{}
+		for table, addresses := range req.Tables {
+			ipAddresses, err := h.checkTable(req.Anchor, table, addresses)
+			if err != nil {
+				return err
+			}
+			tables[table] = ipAddresses
+		}
+		return h.pfctl[req.Anchor].LoadTables(req.Anchor, tables)
+	case "kill":
+		if req.Mode != lbpool.KillStates && req.Mode != lbpool.KillSources {
+			return fmt.Errorf("mode %s not allowed", req.Mode)
+		}
+		if len(req.Addresses) != 1 {
+			return fmt.Errorf("exactly one address required")
+		}
+		ipAddress := net.ParseIP(req.Addresses[0])
+		if ipAddress == nil {
+			return fmt.Errorf("address %s not allowed", req.Addresses[0])
+		}
+		proto := "4"
+		if ipAddress.To4() == nil {
+			proto = "6"
+		}
+		anchor, ok := h.kills[killKey{proto, ipAddress.String()}]
+		if !ok {
+			return fmt.Errorf("address %s not allowed", req.Addresses[0])
+		}
+		return h.pfctl[anchor].KillStates(req.Mode, ipAddress)
+	}
+	return fmt.Errorf("unknown op")
+}
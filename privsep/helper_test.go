@@ -0,0 +1,155 @@
+package privsep
+
+import (
+	"github.com/innogames/yacht/logger"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const helperConfig = `{
+	"backends": {
+		"pf": {"type": "pf"},
+		"lb": {"type": "pf", "anchor": "yacht"},
+		"mem": {"type": "memory"}
+	},
+	"lbpools": {
+		"web": {
+			"ip4": "192.0.2.1",
+			"ip6": "2001:db8::1",
+			"pf_name": "web",
+			"nodes": {
+				"node1": {"ip4": "192.0.2.10", "ip6": "2001:db8::10"},
+				"node2": {"ip4": "192.0.2.11"}
+			}
+		},
+		"api": {
+			"ip4": "192.0.2.2",
+			"pf_name": "api",
+			"backend": "lb",
+			"nodes": {"node3": {"ip4": "192.0.2.20"}}
+		},
+		"cache": {
+			"ip4": "192.0.2.3",
+			"pf_name": "cache",
+			"backend": "mem",
+			"nodes": {"node4": {"ip4": "192.0.2.30"}}
+		}
+	}
+}`
+
+func newTestHelper(t *testing.T) *helper {
+	configFile := filepath.Join(t.TempDir(), "yacht.json")
+	if err := ioutil.WriteFile(configFile, []byte(helperConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &helper{configFile: configFile}
+	if err := h.reload(); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestCheckTable(t *testing.T) {
+	logger.InitLoggers(false)
+	h := newTestHelper(t)
+
+	for _, tc := range []struct {
+		anchor    string
+		table     string
+		addresses []string
+	}{
+		{"", "web_4", []string{"192.0.2.10", "192.0.2.11"}},
+		{"", "web_6", []string{"2001:db8:0::10"}},
+		{"", "web_4", nil},
+		{"yacht", "api_4", []string{"192.0.2.20"}},
+	} {
+		ipAddresses, err := h.checkTable(tc.anchor, tc.table, tc.addresses)
+		if err != nil {
+			t.Errorf("%q %s %s: %v", tc.anchor, tc.table, tc.addresses, err)
+			continue
+		}
+		if len(ipAddresses) != len(tc.addresses) {
+			t.Errorf("%q %s %s: got %s", tc.anchor, tc.table, tc.addresses, ipAddresses)
+		}
+	}
+
+	for _, tc := range []struct {
+		anchor    string
+		table     string
+		addresses []string
+		err       string
+	}{
+		// Unknown tables.
+		{"", "other_4", nil, "not allowed"},
+		{"", "web_6x", nil, "not allowed"},
+		{"yacht", "web_4", nil, "not allowed"},
+		{"", "api_4", nil, "not allowed"},
+		{"", "cache_4", nil, "not allowed"},
+		{"", "web_4; pfctl -F all", nil, "not allowed"},
+		// Unknown addresses.
+		{"", "web_4", []string{"192.0.2.10", "192.0.2.99"}, "address 192.0.2.99 not allowed"},
+		{"", "web_4", []string{"192.0.2.20"}, "address 192.0.2.20 not allowed"},
+		{"", "web_4", []string{"2001:db8::10"}, "address 2001:db8::10 not allowed"},
+		{"", "web_4", []string{"192.0.2.0/24"}, "address 192.0.2.0/24 not allowed"},
+		{"", "web_4", []string{"-f"}, "address -f not allowed"},
+	} {
+		if _, err := h.checkTable(tc.anchor, tc.table, tc.addresses); err == nil || strings.Contains(err.Error(), tc.err) == false {
+			t.Errorf("%q %s %s: got %v, want %s", tc.anchor, tc.table, tc.addresses, err, tc.err)
+		}
+	}
+}
+
+func TestHelperRejectsRequests(t *testing.T) {
+	logger.InitLoggers(false)
+	h := newTestHelper(t)
+
+	for _, req := range []Request{
+		{Op: "show", Table: "other_4"},
+		{Op: "replace", Table: "web_4", Addresses: []string{"192.0.2.99"}},
+		{Op: "load", Anchor: "other", Tables: map[string][]string{"web_4": nil}},
+		{Op: "load", Tables: map[string][]string{"web_4": {"192.0.2.20"}}},
+		{Op: "kill", Mode: "states", Addresses: []string{"192.0.2.99"}},
+		{Op: "kill", Mode: "states", Addresses: []string{"192.0.2.1"}},
+		{Op: "kill", Mode: "states", Addresses: []string{"192.0.2.30"}},
+		{Op: "kill", Mode: "states", Addresses: []string{"0.0.0.0/0"}},
+		{Op: "kill", Mode: "states", Addresses: []string{"192.0.2.10", "192.0.2.11"}},
+		{Op: "kill", Mode: "flush", Addresses: []string{"192.0.2.10"}},
+		{Op: "exec"},
+	} {
+		var resp Response
+		if err := h.handle(req, &resp); err == nil {
+			t.Errorf("request %+v accepted", req)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	if err := CheckConfig(map[string]interface{}{
+		"backends": map[string]interface{}{"pf": map[string]interface{}{"type": "pf"}},
+		"bgp":      map[string]interface{}{},
+	}); err != nil {
+		t.Errorf("pf backend refused: %v", err)
+	}
+
+	err := CheckConfig(map[string]interface{}{
+		"dns": map[string]interface{}{},
+		"vip": map[string]interface{}{},
+		"backends": map[string]interface{}{
+			"pf":  map[string]interface{}{"type": "pf"},
+			"nft": map[string]interface{}{"type": "nftables"},
+			"lvs": map[string]interface{}{"type": "ipvs"},
+			"rt":  map[string]interface{}{"type": "ecmp"},
+			"out": map[string]interface{}{"type": "file"},
+		},
+	})
+	if err == nil {
+		t.Fatal("unsupported configuration accepted")
+	}
+	for _, want := range []string{"dns", "vip", "backend nft", "backend lvs", "backend rt", "backend out"} {
+		if strings.Contains(err.Error(), want) == false {
+			t.Errorf("%s not reported in: %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package privsep
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/innogames/yacht/logger"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Request is sent by unprivileged process to privileged helper.
+type Request struct {
+	Op        string              `json:"op"`
+	Anchor    string              `json:"anchor,omitempty"`
+	Table     string              `json:"table,omitempty"`
+	Addresses []string            `json:"addresses,omitempty"`
+	Tables    map[string][]string `json:"tables,omitempty"`
+	Mode      string              `json:"mode,omitempty"`
+}
+
+// Response is sent back by privileged helper.
+type Response struct {
+	Error   string   `json:"error,omitempty"`
+	Entries []string `json:"entries,omitempty"`
+}
+
+// Client sends operations on pf tables to privileged helper. It implements
+// backend.PFctlExecutor.
+type Client struct {
+	sync.Mutex
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// Start runs privileged helper as a child process connected over a socketpair
+// and drops privileges of this process to given user. Nothing run after Start
+// can change pf tables other than through the helper.
+func Start(configFile string, userName string) (*Client, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fds[0])
+	parentFile := os.NewFile(uintptr(fds[0]), "privsep")
+	childFile := os.NewFile(uintptr(fds[1]), "privsep-helper")
+	defer parentFile.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		childFile.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe, "-c", configFile, "privsep-helper")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Socket of helper is always its file descriptor 3.
+	cmd.ExtraFiles = []*os.File{childFile}
+	err = cmd.Start()
+	childFile.Close()
+	if err != nil {
+		return nil, err
+	}
+	go cmd.Wait()
+
+	conn, err := net.FileConn(parentFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dropPrivileges(userName); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	logger.Info.Printf("privsep: helper pid: %d started, running as %s", cmd.Process.Pid, userName)
+
+	return &Client{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(conn),
+	}, nil
+}
+
+// CheckConfig returns error if configuration uses anything which needs
+// privileges after they are dropped. Only pf tables are changed through the
+// helper, DNS server, VIP manager and other backends would fail.
+func CheckConfig(config map[string]interface{}) error {
+	var unsupported []string
+	for _, feature := range []string{"dns", "vip"} {
+		if _, ok := config[feature]; ok {
+			unsupported = append(unsupported, feature)
+		}
+	}
+	backendsConfig, _ := config["backends"].(map[string]interface{})
+	for name, backendConfig := range backendsConfig {
+		backendConfigMap, _ := backendConfig.(map[string]interface{})
+		switch backendType, _ := backendConfigMap["type"].(string); backendType {
+		case "nftables", "ipvs", "ecmp", "file":
+			unsupported = append(unsupported, fmt.Sprintf("backend %s of type %s", name, backendType))
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("privsep: not supported with privilege separation: %s", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// dropPrivileges switches this process to given user and its primary group.
+func dropPrivileges(userName string) error {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("privileges could be regained")
+	}
+	return nil
+}
+
+// call sends request to helper and waits for its response.
+func (c *Client) call(req Request) (Response, error) {
+	defer c.Unlock()
+	c.Lock()
+
+	var resp Response
+	if err := c.enc.Encode(req); err != nil {
+		return resp, fmt.Errorf("privsep: %v", err)
+	}
+	if err := c.dec.Decode(&resp); err != nil {
+		return resp, fmt.Errorf("privsep: %v", err)
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("privsep: %s", resp.Error)
+	}
+	return resp, nil
+}
+
+// Reload makes helper read configuration again, so that it accepts tables of
+// LB Pools added to configuration.
+func (c *Client) Reload() error {
+	_, err := c.call(Request{Op: "reload"})
+	return err
+}
+
+// ShowTable returns entries of pf table.
+func (c *Client) ShowTable(anchor string, table string) ([]string, error) {
+	resp, err := c.call(Request{Op: "show", Anchor: anchor, Table: table})
+	return resp.Entries, err
+}
+
+// ReplaceTable sets content of pf table to exactly given addresses.
+func (c *Client) ReplaceTable(anchor string, table string, ipAddresses []net.IP) error {
+	_, err := c.call(Request{Op: "replace", Anchor: anchor, Table: table, Addresses: ipStrings(ipAddresses)})
+	return err
+}
+
+// LoadTables replaces content of all given tables at once.
+func (c *Client) LoadTables(anchor string, tables map[string][]net.IP) error {
+	req := Request{Op: "load", Anchor: anchor, Tables: map[string][]string{}}
+	for table, ipAddresses := range tables {
+		req.Tables[table] = ipStrings(ipAddresses)
+	}
+	_, err := c.call(req)
+	return err
+}
+
+// KillStates kills states or source tracking entries going to given address.
+func (c *Client) KillStates(mode string, ipAddress net.IP) error {
+	_, err := c.call(Request{Op: "kill", Mode: mode, Addresses: []string{ipAddress.String()}})
+	return err
+}
+
+func ipStrings(ipAddresses []net.IP) []string {
+	ret := []string{}
+	for _, ipAddress := range ipAddresses {
+		ret = append(ret, ipAddress.String())
+	}
+	return ret
+}
@@ -0,0 +1,51 @@
+//go:build freebsd || openbsd
+// +build freebsd openbsd
+
+package vip
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// ifconfigCmd runs ifconfig to add or remove host address as an alias.
+func ifconfigCmd(iface string, ip net.IP, action string) error {
+	family, bits := "inet6", 128
+	if ip.To4() != nil {
+		family, bits = "inet", 32
+	}
+	args := []string{iface, family, fmt.Sprintf("%s/%d", ip, bits), action}
+	if action == "-alias" {
+		args = []string{iface, family, ip.String(), action}
+	}
+	out, err := exec.Command("/sbin/ifconfig", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ifconfig %s: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// addAddress adds IP address to interface as an alias. Returns false if it was
+// already present.
+func addAddress(iface string, ip net.IP) (bool, error) {
+	present, err := hasAddress(iface, ip)
+	if err != nil || present {
+		return false, err
+	}
+	if err := ifconfigCmd(iface, ip, "alias"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// removeAddress removes alias from interface. Missing address is not an error.
+func removeAddress(iface string, address string) error {
+	ip := net.ParseIP(address)
+	present, err := hasAddress(iface, ip)
+	if err != nil || present == false {
+		return err
+	}
+	return ifconfigCmd(iface, ip, "-alias")
+}
@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package vip
+
+import (
+	"github.com/vishvananda/netlink"
+	"net"
+)
+
+// hostAddr returns netlink address of IP address with host prefix length.
+func hostAddr(ip net.IP) *netlink.Addr {
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}
+}
+
+// addAddress adds IP address to interface. Returns false if it was already present.
+func addAddress(iface string, ip net.IP) (bool, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return false, err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return false, nil
+		}
+	}
+	if err := netlink.AddrAdd(link, hostAddr(ip)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// removeAddress removes IP address from interface. Missing address is not an error.
+func removeAddress(iface string, address string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(address)
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return netlink.AddrDel(link, &addr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !freebsd && !openbsd
+// +build !linux,!freebsd,!openbsd
+
+package vip
+
+import (
+	"errors"
+	"net"
+)
+
+var errNotSupported = errors.New("managing addresses is supported only on Linux, FreeBSD and OpenBSD")
+
+// addAddress reports that managing addresses is not available on this system.
+func addAddress(iface string, ip net.IP) (bool, error) {
+	return false, errNotSupported
+}
+
+// removeAddress reports that managing addresses is not available on this system.
+func removeAddress(iface string, address string) error {
+	return errNotSupported
+}
@@ -0,0 +1,278 @@
+package vip
+
+import (
+	"encoding/json"
+	"github.com/innogames/yacht/lbpool"
+	"github.com/innogames/yacht/logger"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Manager adds IP addresses of serviceable LB Pools to local interfaces and
+// removes them when LB Pools are not serviceable anymore. Only addresses added
+// by Manager are ever removed. Owned addresses removed by someone else are
+// added back. It lives across configuration reloads.
+type Manager struct {
+	sync.Mutex
+
+	// Configuration
+	cleanup       bool
+	stateFile     string
+	checkInterval time.Duration
+
+	// Operation
+	owned      map[string]string
+	followStop chan bool
+	stopChan   chan bool
+}
+
+// NewManager creates Manager from JSON configuration. Addresses owned before
+// restart are read from state file, if configured. Returns nil if Manager is
+// not configured.
+func NewManager(json map[string]interface{}) *Manager {
+	if json == nil {
+		return nil
+	}
+
+	m := new(Manager)
+	m.owned = map[string]string{}
+	m.stopChan = make(chan bool)
+	m.configure(json)
+	m.loadState()
+
+	go m.run()
+	return m
+}
+
+// configure reads settings from JSON configuration.
+func (m *Manager) configure(json map[string]interface{}) {
+	m.cleanup, _ = json["cleanup_on_shutdown"].(bool)
+	m.stateFile, _ = json["state_file"].(string)
+	m.checkInterval = 10 * time.Second
+	if checkInterval, ok := json["check_interval"].(float64); ok && checkInterval > 0 {
+		m.checkInterval = time.Duration(checkInterval * float64(time.Second))
+	}
+}
+
+// Reconfigure applies new configuration on reload. Owned addresses are kept
+// and written to the new state file.
+func (m *Manager) Reconfigure(json map[string]interface{}) {
+	defer m.Unlock()
+	m.Lock()
+
+	stateFile := m.stateFile
+	m.configure(json)
+	if m.stateFile != stateFile {
+		m.saveState()
+	}
+	logger.Info.Printf("vip: cleanup_on_shutdown: %t check_interval: %s reconfigured", m.cleanup, m.checkInterval)
+}
+
+// run periodically checks that owned addresses are still present on their
+// interfaces until Manager is shut down.
+func (m *Manager) run() {
+	m.Lock()
+	checkInterval := m.checkInterval
+	m.Unlock()
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.checkOwned()
+		case <-m.stopChan:
+			return
+		}
+
+		m.Lock()
+		if m.checkInterval != checkInterval {
+			checkInterval = m.checkInterval
+			ticker.Reset(checkInterval)
+		}
+		m.Unlock()
+	}
+}
+
+// checkOwned adds back owned addresses which were removed from interface
+// by someone else.
+func (m *Manager) checkOwned() {
+	defer m.Unlock()
+	m.Lock()
+
+	for address, iface := range m.owned {
+		ip := net.ParseIP(address)
+		present, err := hasAddress(iface, ip)
+		if err != nil {
+			logger.Error.Printf("vip: %s interface: %s %v", address, iface, err)
+			continue
+		}
+		if present {
+			continue
+		}
+		logger.Warning.Printf("vip: %s interface: %s removed externally action: add", address, iface)
+		if _, err := addAddress(iface, ip); err != nil {
+			logger.Error.Printf("vip: %s interface: %s %v", address, iface, err)
+		}
+	}
+}
+
+// hasAddress checks if IP address is present on interface.
+func hasAddress(iface string, ip net.IP) (bool, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return false, err
+	}
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Follow subscribes to changes of LB Pools which have vip_interface configured.
+// Owned addresses of LB Pools not present anymore are removed.
+// It must be called before LB Pools are run.
+func (m *Manager) Follow(lbPools []*lbpool.LBPool) {
+	m.Lock()
+	if m.followStop != nil {
+		close(m.followStop)
+	}
+	m.followStop = make(chan bool)
+	stop := m.followStop
+
+	present := map[string]string{}
+	for _, lbPool := range lbPools {
+		if ipAddress := lbPool.GetIPAddress(); ipAddress != nil && lbPool.GetVIPInterface() != "" {
+			present[ipAddress.String()] = lbPool.GetVIPInterface()
+		}
+	}
+	for address, iface := range m.owned {
+		if present[address] != iface {
+			m.delAddress(address, iface)
+		}
+	}
+	m.Unlock()
+
+	for _, lbPool := range lbPools {
+		if lbPool.GetIPAddress() == nil || lbPool.GetVIPInterface() == "" {
+			continue
+		}
+		go m.follow(lbPool, lbPool.Subscribe(), stop)
+	}
+}
+
+// follow updates address of LB Pool whenever LB Pool changes. Until LB Pool has
+// decided about its nodes, address is left as it is.
+func (m *Manager) follow(lbPool *lbpool.LBPool, changes chan bool, stop chan bool) {
+	for {
+		if serviceable, known := lbPool.GetServiceable(); known {
+			m.setAddress(lbPool, serviceable)
+		}
+		select {
+		case <-changes:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// setAddress adds or removes address of LB Pool on its interface.
+func (m *Manager) setAddress(lbPool *lbpool.LBPool, serviceable bool) {
+	defer m.Unlock()
+	m.Lock()
+
+	address := lbPool.GetIPAddress().String()
+	iface := lbPool.GetVIPInterface()
+	_, owned := m.owned[address]
+
+	if serviceable && owned == false {
+		added, err := addAddress(iface, lbPool.GetIPAddress())
+		if err != nil {
+			logger.Error.Printf(lbPool.GetLogPrefix()+"vip: %s interface: %s %v", address, iface, err)
+			return
+		}
+		if added == false {
+			logger.Debug.Printf(lbPool.GetLogPrefix()+"vip: %s interface: %s already present, not owned", address, iface)
+			return
+		}
+		logger.Info.Printf(lbPool.GetLogPrefix()+"vip: %s interface: %s action: add", address, iface)
+		m.owned[address] = iface
+		m.saveState()
+	} else if serviceable == false && owned {
+		logger.Info.Printf(lbPool.GetLogPrefix()+"vip: %s interface: %s action: remove", address, iface)
+		m.delAddress(address, iface)
+	}
+}
+
+// delAddress removes owned address from interface. Manager must be locked.
+func (m *Manager) delAddress(address string, iface string) {
+	if err := removeAddress(iface, address); err != nil {
+		logger.Error.Printf("vip: %s interface: %s %v", address, iface, err)
+		return
+	}
+	delete(m.owned, address)
+	m.saveState()
+}
+
+// Shutdown stops following LB Pools. All owned addresses are removed if
+// cleanup is requested, as when Manager is removed from configuration, or
+// if configured.
+func (m *Manager) Shutdown(cleanup bool) {
+	defer m.Unlock()
+	m.Lock()
+
+	close(m.stopChan)
+	if m.followStop != nil {
+		close(m.followStop)
+		m.followStop = nil
+	}
+	if cleanup == false && m.cleanup == false {
+		return
+	}
+	for address, iface := range m.owned {
+		logger.Info.Printf("vip: %s interface: %s action: remove", address, iface)
+		m.delAddress(address, iface)
+	}
+}
+
+// loadState reads owned addresses from state file.
+func (m *Manager) loadState() {
+	if m.stateFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(m.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) == false {
+			logger.Error.Printf("vip: unable to read state file: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &m.owned); err != nil {
+		logger.Error.Printf("vip: unable to parse state file: %v", err)
+		m.owned = map[string]string{}
+	}
+}
+
+// saveState writes owned addresses to state file.
+func (m *Manager) saveState() {
+	if m.stateFile == "" {
+		return
+	}
+	data, _ := json.Marshal(m.owned)
+	tmpFile := m.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		logger.Error.Printf("vip: unable to write state file: %v", err)
+		return
+	}
+	if err := os.Rename(tmpFile, m.stateFile); err != nil {
+		logger.Error.Printf("vip: unable to write state file: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package vip
+
+import (
+	"github.com/innogames/yacht/logger"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManagerReconfigure(t *testing.T) {
+	logger.InitLoggers(false)
+
+	if NewManager(nil) != nil {
+		t.Fatal("Manager created without configuration")
+	}
+
+	dir := t.TempDir()
+	oldState := filepath.Join(dir, "old.json")
+	newState := filepath.Join(dir, "new.json")
+	if err := ioutil.WriteFile(oldState, []byte(`{"192.0.2.1":"lo0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(map[string]interface{}{"state_file": oldState})
+	defer m.Shutdown(false)
+
+	m.Reconfigure(map[string]interface{}{
+		"state_file":          newState,
+		"cleanup_on_shutdown": true,
+		"check_interval":      0.5,
+	})
+	m.Lock()
+	defer m.Unlock()
+	if m.cleanup == false || m.checkInterval != 500*time.Millisecond {
+		t.Errorf("settings not applied: cleanup %t check_interval %s", m.cleanup, m.checkInterval)
+	}
+	data, err := ioutil.ReadFile(newState)
+	if err != nil || string(data) != `{"192.0.2.1":"lo0"}` {
+		t.Errorf("owned addresses not moved to new state file: %s %v", data, err)
+	}
+	if m.owned["192.0.2.1"] != "lo0" {
+		t.Errorf("owned addresses lost: %v", m.owned)
+	}
+	// Cleanup must not run against real interfaces.
+	m.cleanup = false
+	m.owned = map[string]string{}
+}